@@ -0,0 +1,145 @@
+package ttyd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var errForbiddenIP = &StatusError{Code: http.StatusForbidden, Message: "ip not allowed"}
+
+// IPRules are the network access control rules of FilterIP.
+type IPRules struct {
+	// Allow lists the networks allowed to connect. If it's empty, every network not denied is allowed.
+	Allow []netip.Prefix
+	// Deny lists the networks not allowed to connect. It takes precedence over Allow.
+	Deny []netip.Prefix
+	// TrustedProxies lists the networks of the reverse proxies whose Forwarded or X-Forwarded-For headers
+	// are used to find the client IP.
+	TrustedProxies []netip.Prefix
+}
+
+// FilterIP returns a handler that rejects the clients denied by the rules with status 403, and calls next with
+// the others. Wrap the whole site with it, so that the rules apply to both the pages and the WebSocket endpoint.
+// Clients whose IP can't be determined are rejected. The request passed to next carries the client IP, which
+// Handlers use instead of the remote address for the client limits, rate limiting, audit and SessionInfo, see
+// RequestClientIP. Without Allow and Deny, it only finds the client IP behind the trusted proxies.
+func FilterIP(next http.Handler, rules IPRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ok := ClientIP(r, rules.TrustedProxies)
+		if !ok || !rules.allowed(ip) {
+			http.Error(w, errForbiddenIP.Message, errForbiddenIP.Code)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+type clientIPKey struct{}
+
+// RequestClientIP returns the client IP found by FilterIP, or the IP of the remote address of the request
+// if there isn't one.
+func RequestClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return ip.String()
+	}
+	return addrIP(r.RemoteAddr)
+}
+
+// remoteAddr returns the address of the client of the connection, which is the client IP found by FilterIP
+// if the connection is upgraded from r.
+func remoteAddr(r *http.Request, conn net.Conn) string {
+	if r != nil {
+		if ip, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+			return ip.String()
+		}
+	}
+	return conn.RemoteAddr().String()
+}
+
+func (rules *IPRules) allowed(ip netip.Addr) bool {
+	if containsAddr(rules.Deny, ip) {
+		return false
+	}
+	return len(rules.Allow) == 0 || containsAddr(rules.Allow, ip)
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client of the request. If the request comes from one of the trusted proxies
+// or a unix socket, the addresses in the Forwarded header, or X-Forwarded-For if there is no Forwarded header,
+// are walked from the nearest one, and the first address not of a trusted proxy is the client.
+// It reports false if the IP can't be determined, for example the proxy reports an obfuscated address.
+func ClientIP(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	ip, err := netip.ParseAddr(addrIP(r.RemoteAddr))
+	switch {
+	case err == nil:
+		ip = ip.Unmap()
+		if !containsAddr(trusted, ip) {
+			return ip, true
+		}
+	case !overUnixSocket(r):
+		return netip.Addr{}, false
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = hop.Unmap()
+		if !containsAddr(trusted, ip) {
+			break
+		}
+	}
+	return ip, ip.IsValid()
+}
+
+// forwardedFor returns the client addresses reported by the proxies, from the farthest to the nearest.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || !strings.EqualFold(key, "for") {
+						continue
+					}
+					hops = append(hops, forwardedNode(strings.Trim(node, `"`)))
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// forwardedNode returns the IP of a node of the Forwarded header, such as 192.0.2.1:80 or [2001:db8::1]:80.
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		node, _, _ = strings.Cut(node[1:], "]")
+		return node
+	}
+	host, _, ok := strings.Cut(node, ":")
+	if ok {
+		return host
+	}
+	return node
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestFilterIPClientIP(t *testing.T) {
+	infos := make(chan SessionInfo, 2)
+	h := NewCommandHandler(shell("sleep 1; echo hello"), WithMaxClientsPerIP(1), OnSessionStart(func(info SessionInfo) {
+		infos <- info
+	}))
+	url := startServer(t, FilterIP(h, IPRules{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}))
+
+	// the clients behind the proxy are limited by their own IPs
+	forwarded := func(ip string) client.Option {
+		return client.WithHeader("X-Forwarded-For", ip)
+	}
+	conns := []*client.Conn{
+		dial(t, url, forwarded("192.0.2.1")),
+		dial(t, url, forwarded("192.0.2.2")),
+	}
+	_, err := client.Dial(context.Background(), url, client.WithToken(""), forwarded("192.0.2.1"))
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("dial over the limit of the IP = %v", err)
+	}
+	for _, conn := range conns {
+		if out, ce := readAll(t, conn); !strings.Contains(out, "hello") {
+			t.Fatalf("output = %q, closed with %v", out, ce)
+		}
+	}
+
+	addrs := []string{(<-infos).RemoteAddr, (<-infos).RemoteAddr}
+	if addrs[0] == addrs[1] || !strings.HasPrefix(addrs[0], "192.0.2.") || !strings.HasPrefix(addrs[1], "192.0.2.") {
+		t.Fatalf("remote addresses of the sessions = %q", addrs)
+	}
+}
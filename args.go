@@ -0,0 +1,38 @@
+package ttyd
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// An ArgValidator validates the arguments a client passes with the arg query parameters. The arguments
+// are only used if it returns nil. Returned error is reported to the client with status 400 unless it's a *StatusError.
+type ArgValidator func(args []string) error
+
+// AllowArgs returns an ArgValidator that only accepts arguments that are one of the values.
+func AllowArgs(values ...string) ArgValidator {
+	values = slices.Clone(values)
+	return func(args []string) error {
+		for _, arg := range args {
+			if !slices.Contains(values, arg) {
+				return fmt.Errorf("argument not allowed: %q", arg)
+			}
+		}
+		return nil
+	}
+}
+
+// MatchArgs returns an ArgValidator that only accepts arguments fully matching the regular expression.
+// It panics if the expression can't be parsed.
+func MatchArgs(pattern string) ArgValidator {
+	re := regexp.MustCompile(`^(?:` + pattern + `)$`)
+	return func(args []string) error {
+		for _, arg := range args {
+			if !re.MatchString(arg) {
+				return fmt.Errorf("argument not allowed: %q", arg)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestArgValidators(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		validate ArgValidator
+		args     []string
+		ok       bool
+	}{
+		{"allow none", AllowArgs("a", "b"), nil, true},
+		{"allow", AllowArgs("a", "b"), []string{"b", "a"}, true},
+		{"allow other", AllowArgs("a", "b"), []string{"a", "c"}, false},
+		{"allow prefix", AllowArgs("a", "b"), []string{"ab"}, false},
+		{"match", MatchArgs(`[a-z]+`), []string{"foo", "bar"}, true},
+		{"match partially", MatchArgs(`[a-z]+`), []string{"foo1"}, false},
+		{"match alternation", MatchArgs(`a|bc`), []string{"a", "bc"}, true},
+		{"match alternation partially", MatchArgs(`a|bc`), []string{"ac"}, false},
+		{"match empty", MatchArgs(`[a-z]+`), []string{""}, false},
+	} {
+		if err := tt.validate(tt.args); (err == nil) != tt.ok {
+			t.Errorf("%s: validate(%q) = %v", tt.name, tt.args, err)
+		}
+	}
+}
+
+func TestURLArgs(t *testing.T) {
+	validate := AllowArgs("foo", "bar")
+	h := NewCommandHandler(shell(`echo args "$0" "$@"`), EnableURLArgs(func(args []string) error {
+		if len(args) > 2 {
+			return &StatusError{Code: http.StatusRequestEntityTooLarge, Message: "too many arguments"}
+		}
+		return validate(args)
+	}))
+	url := startServer(t, h)
+
+	out, _ := readAll(t, dial(t, url+"/?arg=foo&arg=bar"))
+	if !strings.Contains(out, "args foo bar") {
+		t.Fatalf("output = %q", out)
+	}
+	for query, status := range map[string]string{
+		"/?arg=baz":                 "400",
+		"/?arg=foo&arg=foo&arg=foo": "413",
+	} {
+		_, err := client.Dial(context.Background(), url+query, client.WithToken(""))
+		if err == nil || !strings.Contains(err.Error(), status) {
+			t.Errorf("dial %s = %v, want status %s", query, err, status)
+		}
+	}
+}
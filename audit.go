@@ -0,0 +1,318 @@
+package ttyd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of audit events.
+const (
+	// AuditConnect is recorded when a client attaches to a session.
+	AuditConnect = "connect"
+	// AuditDisconnect is recorded when a client is disconnected.
+	AuditDisconnect = "disconnect"
+	// AuditStart is recorded when the process of a session is started.
+	AuditStart = "start"
+	// AuditEnd is recorded when the process of a session is waited.
+	AuditEnd = "end"
+	// AuditInput is recorded for each client input forwarded to the tty, if enabled.
+	AuditInput = "input"
+)
+
+// AuditEvent is an entry of the audit trail.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Session    string    `json:"session"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Command    []string  `json:"command,omitempty"`
+	Writable   bool      `json:"writable,omitempty"`
+	Pid        int       `json:"pid,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	// Data is the exact input bytes of an AuditInput event.
+	Data []byte `json:"data,omitempty"`
+}
+
+// An AuditSink records the audit events of a Handler. Record is called synchronously from the goroutines
+// serving the clients, so it should be fast and must be safe for concurrent use.
+type AuditSink interface {
+	Record(event AuditEvent)
+}
+
+func (h *Handler) audit(event AuditEvent) {
+	if h.auditSink != nil {
+		event.Time = time.Now()
+		h.auditSink.Record(event)
+	}
+}
+
+// audit records an event about the client.
+func (d *daemon) audit(typ string, data []byte) {
+	s := d.session
+	event := AuditEvent{
+		Type:       typ,
+		Session:    s.id,
+		User:       d.user,
+		RemoteAddr: d.remoteAddr,
+		Data:       data,
+	}
+	switch typ {
+	case AuditConnect:
+		event.Command = s.cmd.Args
+		event.Writable = d.writable.Load()
+	case AuditDisconnect:
+		event.Reason = d.reason.String()
+	}
+	s.h.audit(event)
+}
+
+// audit records an event about the process of the session.
+func (s *session) audit(typ string, info SessionInfo) {
+	event := AuditEvent{
+		Type:       typ,
+		Session:    info.ID,
+		User:       info.User,
+		RemoteAddr: info.RemoteAddr,
+		Command:    s.cmd.Args,
+		Pid:        info.Pid,
+	}
+	if typ == AuditEnd {
+		event.ExitCode = &info.ExitCode
+		event.Reason = info.Reason.String()
+	}
+	s.h.audit(event)
+}
+
+// AuditLog is an AuditSink writing the events as JSON lines to a file. Each line has a prev field with
+// the HMAC-SHA256 of the previous line in hex, or its SHA-256 if there is no key, so modifying or removing lines
+// breaks the chain, see VerifyAuditLog. Without a key, anyone who can write the file can also rewrite the chain,
+// and with one, lines can still be removed from the end, so keep the hash of the last line somewhere else,
+// such as a remote log, to detect that.
+// The file is rotated when it would exceed the size limit, and the chain continues in the new file.
+type AuditLog struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+	key        []byte
+
+	lock    sync.Mutex
+	f       *os.File
+	size    int64
+	prev    string
+	err     error
+	onError func(error)
+	closed  bool
+}
+
+// NewAuditLog opens the audit log file for appending, and continues the chain from its last line. The chain is
+// keyed with key unless it's empty, which must be kept secret from those who can write the file.
+// When the file would exceed maxSize bytes, it's renamed with the suffix .1, and older backups are shifted
+// up to maxBackups, the oldest one is removed. Zero or negative maxSize disables rotation.
+func NewAuditLog(name string, maxSize int64, maxBackups int, key []byte) (*AuditLog, error) {
+	l := &AuditLog{
+		name:       name,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		key:        key,
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	last, size, err := lastLine(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	l.f, l.size = f, size
+	if last != nil {
+		l.prev = lineHash(last, key)
+	}
+	return l, nil
+}
+
+// lastLine returns the last line of the file and the file size.
+func lastLine(f *os.File) ([]byte, int64, error) {
+	var (
+		last []byte
+		size int64
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<26)
+	for scanner.Scan() {
+		size += int64(len(scanner.Bytes())) + 1
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	return last, size, scanner.Err()
+}
+
+func lineHash(line, key []byte) string {
+	if len(key) == 0 {
+		sum := sha256.Sum256(line)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(line)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Prev string `json:"prev"`
+	AuditEvent
+}
+
+// Record writes the event to the file. If it fails, the event is dropped and the error is passed to the function
+// set by OnError, and the next event is tried again, reopening the file if it's closed by a failed rotation.
+func (l *AuditLog) Record(event AuditEvent) {
+	l.lock.Lock()
+	err := l.record(event)
+	l.err = err
+	onError := l.onError
+	l.lock.Unlock()
+
+	if err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+func (l *AuditLog) record(event AuditEvent) error {
+	if l.closed {
+		return nil
+	}
+	if l.f == nil {
+		err := l.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(auditEntry{
+		Prev:       l.prev,
+		AuditEvent: event,
+	})
+	if err != nil {
+		return err
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line))+1 > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(append(line, '\n'))
+	if err != nil {
+		// a partial line would break the chain
+		if n > 0 {
+			_ = l.f.Truncate(l.size)
+		}
+		return err
+	}
+	l.size += int64(n)
+	l.prev = lineHash(line, l.key)
+	return nil
+}
+
+// open opens the file for appending.
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *AuditLog) rotate() error {
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return err
+	}
+	if l.maxBackups > 0 {
+		_ = os.Remove(l.name + "." + strconv.Itoa(l.maxBackups))
+		for i := l.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(l.name+"."+strconv.Itoa(i), l.name+"."+strconv.Itoa(i+1))
+		}
+		err = os.Rename(l.name, l.name+".1")
+	} else {
+		err = os.Remove(l.name)
+	}
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// OnError sets the function called with the errors writing the file, such as to log them.
+func (l *AuditLog) OnError(fn func(error)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.onError = fn
+}
+
+// Err returns the error recording the last event, or nil if it's recorded.
+func (l *AuditLog) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+// Close closes the file.
+func (l *AuditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+var errBrokenChain = errors.New("ttyd: audit log hash chain is broken")
+
+// VerifyAuditLog checks the hash chain of the audit log read from r with the key of the log. prev is the hash
+// the first line should refer to, which is the one returned by verifying the previous file for rotated logs;
+// an empty prev skips checking the first line. It returns the hash of the last line to verify the next file with,
+// compare it with the one kept elsewhere to detect removed lines at the end.
+func VerifyAuditLog(r io.Reader, prev string, key []byte) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<26)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry auditEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+		if prev != "" && entry.Prev != prev {
+			return "", fmt.Errorf("line %d: %w", n, errBrokenChain)
+		}
+		prev = lineHash(line, key)
+	}
+	return prev, scanner.Err()
+}
@@ -0,0 +1,81 @@
+package ttyd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("secret")
+	l, err := NewAuditLog(name, 0, 0, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		l.Record(AuditEvent{Type: AuditConnect, Session: "s1", User: user})
+	}
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = VerifyAuditLog(bytes.NewReader(data), "", key); err != nil {
+		t.Fatal("verify:", err)
+	}
+	if _, err = VerifyAuditLog(bytes.NewReader(data), "", []byte("other")); !errors.Is(err, errBrokenChain) {
+		t.Fatal("verify with another key:", err)
+	}
+	tampered := bytes.Replace(data, []byte("bob"), []byte("eve"), 1)
+	if _, err = VerifyAuditLog(bytes.NewReader(tampered), "", key); !errors.Is(err, errBrokenChain) {
+		t.Fatal("verify tampered:", err)
+	}
+}
+
+func TestAuditLogRetry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audit")
+	err := os.Mkdir(dir, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "audit.log")
+	l, err := NewAuditLog(name, 1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var errs []error
+	l.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+
+	l.Record(AuditEvent{Type: AuditStart, Session: "s1"})
+	// rotating fails without the directory
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(AuditEvent{Type: AuditEnd, Session: "s1"})
+	if len(errs) != 1 || l.Err() == nil {
+		t.Fatalf("errors = %v, Err = %v", errs, l.Err())
+	}
+
+	err = os.Mkdir(dir, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(AuditEvent{Type: AuditStart, Session: "s2"})
+	if l.Err() != nil {
+		t.Fatal("record after the error:", l.Err())
+	}
+	data, err := os.ReadFile(name)
+	if err != nil || !bytes.Contains(data, []byte(`"s2"`)) {
+		t.Fatalf("audit log = %q, %v", data, err)
+	}
+}
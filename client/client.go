@@ -0,0 +1,502 @@
+// Package client connects to ttyd servers with the ttyd protocol, so that programs and terminals can use
+// the sessions without a browser.
+//
+//	conn, err := client.Dial(ctx, "wss://example.com/ws", client.WithBasicAuth("user", "password"))
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//	go io.Copy(conn, os.Stdin)
+//	_, err = io.Copy(os.Stdout, conn)
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+const ttyProtocol = "tty"
+
+const (
+	input          = '0'
+	resizeTerminal = '1'
+	pause          = '2'
+	resume         = '3'
+
+	output         = '0'
+	setWindowTitle = '1'
+	setPreference  = '2'
+)
+
+// maxInput is the maximum size of the input in a message, so that the messages are within the default message size limit
+// of the server.
+const maxInput = 4095
+
+var (
+	// compressionTail is the end of a flushed deflate block, removed from the compressed messages
+	compressionTail = []byte{0, 0, 0xff, 0xff}
+	// compressionReadTail is compressionTail followed by a final empty block, so that reading a message ends with io.EOF
+	compressionReadTail = []byte{0, 0, 0xff, 0xff, 1, 0, 0, 0xff, 0xff}
+
+	errClosed = errors.New("ttyd: use of closed connection")
+)
+
+// CloseError is the close code and reason sent by the server when it ends the connection, such as the exit status
+// of the process.
+type CloseError struct {
+	Code   ws.StatusCode
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("ttyd: connection closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("ttyd: connection closed with code %d: %s", e.Code, e.Reason)
+}
+
+type dialer struct {
+	header      http.Header
+	tlsConfig   *tls.Config
+	http2       bool
+	eventStream bool
+	compress    bool
+	columns     uint16
+	rows        uint16
+	token       string
+	tokenSet    bool
+	tokenURL    string
+
+	onTitle       func(string)
+	onPreferences func(map[string]any)
+}
+
+// Conn is a connection to a ttyd session. Reading from it returns the output of the process, and writing to it sends
+// input to the process. Read must be called continuously, as the messages and pings of the server are handled by it.
+// Only one goroutine may call Read at a time, while the other methods are safe for concurrent use.
+type Conn struct {
+	br     *bufio.Reader
+	closer func() error
+
+	// read side
+	out           []byte
+	msg           bytes.Buffer
+	fr            io.ReadCloser
+	sw            bytes.Buffer
+	compressed    bool
+	takeover      bool
+	err           error
+	onTitle       func(string)
+	onPreferences func(map[string]any)
+
+	// write side
+	lock   sync.Mutex
+	bw     *bufio.Writer
+	wb     bytes.Buffer
+	cb     bytes.Buffer
+	fw     *flate.Writer
+	closed bool
+
+	closeErr *CloseError
+}
+
+// Dial connects to the ttyd server at the WebSocket URL, which may have the scheme ws, wss, http or https,
+// and sends the first message with the token and the terminal size. Query parameters such as session and arg
+// are passed to the server as is. ctx only applies to connecting.
+func Dial(ctx context.Context, rawURL string, options ...Option) (*Conn, error) {
+	d := newDialer(options)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("ttyd: unsupported scheme %q", u.Scheme)
+	}
+
+	if !d.tokenSet {
+		d.token, err = d.fetchToken(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var c *Conn
+	switch {
+	case d.eventStream:
+		c, err = d.dialEventStream(ctx, u)
+	case d.http2:
+		c, err = d.dialHTTP2(ctx, u)
+	default:
+		c, err = d.dialHTTP1(ctx, u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.onTitle = d.onTitle
+	c.onPreferences = d.onPreferences
+
+	init, _ := json.Marshal(struct {
+		AuthToken string `json:"AuthToken"`
+		Columns   uint16 `json:"columns"`
+		Rows      uint16 `json:"rows"`
+	}{d.token, d.columns, d.rows})
+	c.lock.Lock()
+	err = c.writeFrame(init)
+	c.lock.Unlock()
+	if err != nil {
+		_ = c.closer()
+		return nil, err
+	}
+	return c, nil
+}
+
+// fetchToken fetches the token for the first message. Servers that don't answer with the token in JSON, such as
+// those without the token endpoint, get an empty token.
+func (d *dialer) fetchToken(ctx context.Context, u *url.URL) (string, error) {
+	tokenURL := d.tokenURL
+	if tokenURL == "" {
+		tokenURL = u.ResolveReference(&url.URL{Path: "token"}).String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = d.header.Clone()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// the transport adds h2 to the protocols of its config, which would be offered by the WebSocket dial too
+	transport.TLSClientConfig = d.tlsConfig.Clone()
+	defer transport.CloseIdleConnections()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// servers without token auth may serve anything at the URL, they don't verify the token anyway
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", nil
+	}
+	return body.Token, nil
+}
+
+func (d *dialer) dialHTTP1(ctx context.Context, u *url.URL) (*Conn, error) {
+	wsURL := *u
+	wsURL.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	dialer := ws.Dialer{
+		Header:    ws.HandshakeHeaderHTTP(d.header),
+		Protocols: []string{ttyProtocol},
+		TLSConfig: d.tlsConfig,
+	}
+	if d.compress {
+		dialer.Extensions = []httphead.Option{wsflate.DefaultParameters.Option()}
+	}
+	conn, br, hs, err := dialer.Dial(ctx, wsURL.String())
+	if err != nil {
+		return nil, err
+	}
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+
+	c := newConn(br, conn, conn.Close)
+	c.negotiated(hs.Extensions)
+	return c, nil
+}
+
+// newConn returns a Conn reading the frames from br and writing them to w. closer closes the underlying connection.
+func newConn(br *bufio.Reader, w io.Writer, closer func() error) *Conn {
+	var once sync.Once
+	return &Conn{
+		br: br,
+		bw: bufio.NewWriter(w),
+		closer: func() (err error) {
+			once.Do(func() {
+				err = closer()
+			})
+			return err
+		},
+	}
+}
+
+// negotiated enables compression if the server accepted permessage-deflate.
+func (c *Conn) negotiated(extensions []httphead.Option) {
+	for _, ext := range extensions {
+		if !bytes.Equal(ext.Name, wsflate.ExtensionNameBytes) {
+			continue
+		}
+		var p wsflate.Parameters
+		if p.Parse(ext) != nil {
+			return
+		}
+		c.compressed = true
+		c.takeover = !p.ServerNoContextTakeover
+		c.fr = flate.NewReader(bytes.NewReader(nil))
+		// compressing each message independently is always allowed
+		c.fw, _ = flate.NewWriter(&c.cb, flate.DefaultCompression)
+		return
+	}
+}
+
+// Read reads the output of the process. Title and preference messages are passed to the callbacks.
+// It returns io.EOF after the server closes the connection normally, or a *CloseError with the close code otherwise.
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.err = c.nextMessage()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// nextMessage reads the next message and handles it. Control frames are handled in between.
+func (c *Conn) nextMessage() error {
+	c.msg.Reset()
+	var started, compressed bool
+	for {
+		hdr, err := ws.ReadHeader(c.br)
+		if err != nil {
+			return err
+		}
+		if hdr.OpCode.IsControl() {
+			err = c.handleControl(hdr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !started {
+			started = true
+			compressed = hdr.Rsv1()
+		}
+
+		idx := c.msg.Len()
+		_, err = io.CopyN(&c.msg, c.br, hdr.Length)
+		if err != nil {
+			return err
+		}
+		if hdr.Masked {
+			ws.Cipher(c.msg.Bytes()[idx:], hdr.Mask, 0)
+		}
+		if hdr.Fin {
+			break
+		}
+	}
+
+	msg := c.msg.Bytes()
+	if compressed && c.compressed {
+		var err error
+		msg, err = c.inflate(msg)
+		if err != nil {
+			return err
+		}
+	}
+	if len(msg) == 0 {
+		return nil
+	}
+
+	switch msg[0] {
+	case output:
+		c.out = msg[1:]
+	case setWindowTitle:
+		if c.onTitle != nil {
+			c.onTitle(string(msg[1:]))
+		}
+	case setPreference:
+		if c.onPreferences != nil {
+			var preferences map[string]any
+			if json.Unmarshal(msg[1:], &preferences) == nil {
+				c.onPreferences(preferences)
+			}
+		}
+	}
+	return nil
+}
+
+// inflate decompresses the message. If the server takes over the context, the previous output is the dictionary.
+func (c *Conn) inflate(msg []byte) ([]byte, error) {
+	src := bytes.NewReader(append(msg, compressionReadTail...))
+	var dict []byte
+	if c.takeover {
+		dict = c.sw.Bytes()
+	}
+	_ = c.fr.(flate.Resetter).Reset(src, dict)
+
+	var out bytes.Buffer
+	_, err := out.ReadFrom(c.fr)
+	if err != nil {
+		return nil, err
+	}
+	if c.takeover {
+		c.sw.Next(max(c.sw.Len()+out.Len()-32768, 0))
+		c.sw.Write(out.Bytes())
+	}
+	return out.Bytes(), nil
+}
+
+func (c *Conn) handleControl(hdr ws.Header) error {
+	payload := make([]byte, hdr.Length)
+	_, err := io.ReadFull(c.br, payload)
+	if err != nil {
+		return err
+	}
+	if hdr.Masked {
+		ws.Cipher(payload, hdr.Mask, 0)
+	}
+
+	switch hdr.OpCode {
+	case ws.OpPing:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.closed {
+			return nil
+		}
+		return c.writeControl(ws.NewPongFrame(payload))
+	case ws.OpClose:
+		ce := &CloseError{Code: ws.StatusNoStatusRcvd}
+		if len(payload) >= 2 {
+			ce.Code = ws.StatusCode(binary.BigEndian.Uint16(payload))
+			ce.Reason = string(payload[2:])
+		}
+		c.lock.Lock()
+		c.closeErr = ce
+		if !c.closed {
+			c.closed = true
+			_ = c.writeControl(ws.NewCloseFrame(ws.NewCloseFrameBody(ce.Code, "")))
+		}
+		c.lock.Unlock()
+		_ = c.closer()
+		if ce.Code == ws.StatusNormalClosure {
+			return io.EOF
+		}
+		return ce
+	}
+	return nil
+}
+
+// CloseError returns the close code and reason sent by the server, or nil if the server hasn't closed the connection.
+// The reason is the exit status of the process if it exited.
+func (c *Conn) CloseError() *CloseError {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closeErr
+}
+
+// writeControl writes a control frame. The lock must be held.
+func (c *Conn) writeControl(frame ws.Frame) error {
+	err := ws.WriteFrame(c.bw, ws.MaskFrameInPlace(frame))
+	if err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// writeFrame writes the message as a binary frame, compressed if negotiated. The lock must be held.
+func (c *Conn) writeFrame(msg []byte) error {
+	if c.closed {
+		return errClosed
+	}
+
+	frame := ws.NewBinaryFrame(msg)
+	if c.compressed {
+		c.cb.Reset()
+		c.fw.Reset(&c.cb)
+		_, _ = c.fw.Write(msg)
+		_ = c.fw.Flush()
+		frame = ws.NewBinaryFrame(c.cb.Bytes()[:c.cb.Len()-len(compressionTail)])
+		frame.Header.Rsv = ws.Rsv(true, false, false)
+	}
+	err := ws.WriteFrame(c.bw, ws.MaskFrameInPlace(frame))
+	if err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// send writes a message of the type with the payload.
+func (c *Conn) send(typ byte, p []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.wb.Reset()
+	c.wb.WriteByte(typ)
+	c.wb.Write(p)
+	return c.writeFrame(c.wb.Bytes())
+}
+
+// Write sends p as input to the process. Input of read-only clients is discarded by the server.
+func (c *Conn) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxInput)]
+		err := c.send(input, chunk)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Resize reports the new size of the terminal.
+func (c *Conn) Resize(columns, rows uint16) error {
+	size, _ := json.Marshal(struct {
+		Columns uint16 `json:"columns"`
+		Rows    uint16 `json:"rows"`
+	}{columns, rows})
+	return c.send(resizeTerminal, size)
+}
+
+// Pause asks the server to stop sending output until Resume is called. The process is blocked on writing
+// once the tty buffer is full.
+func (c *Conn) Pause() error {
+	return c.send(pause, nil)
+}
+
+// Resume asks the server to continue sending output.
+func (c *Conn) Resume() error {
+	return c.send(resume, nil)
+}
+
+// Close sends a close frame and closes the connection. The session ends unless other clients are attached
+// or the server keeps detached sessions.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		_ = c.writeControl(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "")))
+	}
+	c.lock.Unlock()
+	return c.closer()
+}
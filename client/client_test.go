@@ -0,0 +1,82 @@
+//go:build !windows
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go"
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestDialWithoutToken(t *testing.T) {
+	for _, token := range []http.HandlerFunc{
+		http.NotFound,
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "<html></html>")
+		},
+	} {
+		mux := http.NewServeMux()
+		mux.Handle("/token", token)
+		mux.Handle("/ws", ttyd.NewHandler(exec.Command("echo", "hello")))
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := client.Dial(ctx, srv.URL+"/ws")
+		cancel()
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		out, err := io.ReadAll(conn)
+		var ce *client.CloseError
+		if err != nil && !errors.As(err, &ce) {
+			t.Fatal("read:", err)
+		}
+		_ = conn.Close()
+		if !strings.Contains(string(out), "hello") {
+			t.Fatalf("output = %q", out)
+		}
+	}
+}
+
+func TestDialEventStream(t *testing.T) {
+	h := ttyd.NewHandler(exec.Command("sh", "-c", `read line; echo "got $line"`), ttyd.EnableClientInput())
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	conn, err := client.Dial(ctx, srv.URL, client.WithToken(""), client.WithEventStream())
+	cancel()
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello\n"))
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	out, err := io.ReadAll(conn)
+	var ce *client.CloseError
+	if err != nil && !errors.As(err, &ce) {
+		t.Fatal("read:", err)
+	}
+	if ce = conn.CloseError(); ce == nil || ce.Reason != "exit status 0" {
+		t.Fatalf("closed with %v", ce)
+	}
+	if !strings.Contains(string(out), "got hello") {
+		t.Fatalf("output = %q", out)
+	}
+}
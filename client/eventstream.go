@@ -0,0 +1,208 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gobwas/ws"
+)
+
+// eventStreamParam is the query parameter carrying the stream ID of the messages POSTed to an event stream.
+const eventStreamParam = "stream"
+
+var errNoStreamID = errors.New("ttyd: event stream doesn't start with the stream ID")
+
+// dialEventStream connects with Server-Sent Events. The events are translated to the WebSocket frames of the server
+// for Conn to read, and the frames written by Conn are POSTed to the server as messages with the stream ID.
+func (d *dialer) dialEventStream(ctx context.Context, u *url.URL) (*Conn, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = d.tlsConfig.Clone()
+
+	// the stream outlives ctx, which only applies to connecting
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	fail := func(err error) (*Conn, error) {
+		cancel()
+		transport.CloseIdleConnections()
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header = d.header.Clone()
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		stop()
+		return fail(err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); resp.StatusCode != http.StatusOK || mediaType != "text/event-stream" {
+		stop()
+		_ = resp.Body.Close()
+		return fail(fmt.Errorf("ttyd: unexpected response status %s", resp.Status))
+	}
+
+	es := &eventStream{
+		br: bufio.NewReader(resp.Body),
+	}
+	typ, data, err := es.next()
+	if !stop() {
+		err = context.Cause(ctx)
+	}
+	if err == nil && (typ != "stream" || data == "") {
+		err = errNoStreamID
+	}
+	if err != nil {
+		_ = resp.Body.Close()
+		return fail(err)
+	}
+
+	postURL := *u
+	query := postURL.Query()
+	query.Set(eventStreamParam, data)
+	postURL.RawQuery = query.Encode()
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := d.postLoop(streamCtx, transport, postURL.String(), pr)
+		_ = pr.CloseWithError(err)
+	}()
+
+	return newConn(bufio.NewReader(es), pw, func() error {
+		_ = pw.Close()
+		err := resp.Body.Close()
+		cancel()
+		<-done
+		transport.CloseIdleConnections()
+		return err
+	}), nil
+}
+
+// postLoop POSTs the messages of the frames read from r until the close frame or an error.
+func (d *dialer) postLoop(ctx context.Context, transport http.RoundTripper, postURL string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		frame, err := ws.ReadFrame(br)
+		if err != nil {
+			return err
+		}
+		if frame.Header.Masked {
+			ws.Cipher(frame.Payload, frame.Header.Mask, 0)
+		}
+		switch frame.Header.OpCode {
+		case ws.OpClose:
+			return io.EOF
+		case ws.OpBinary, ws.OpText:
+		default:
+			// pings are comments of the event stream, which aren't answered
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, postURL, bytes.NewReader(frame.Payload))
+		if err != nil {
+			return err
+		}
+		req.Header = d.header.Clone()
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("ttyd: unexpected response status %s", resp.Status)
+		}
+	}
+}
+
+// eventStream reads the events of the server as WebSocket frames. Each message event is a message in base64,
+// and a close event carries the close code and reason in JSON.
+type eventStream struct {
+	br  *bufio.Reader
+	buf bytes.Buffer
+}
+
+func (es *eventStream) Read(p []byte) (int, error) {
+	for es.buf.Len() == 0 {
+		typ, data, err := es.next()
+		if err != nil {
+			return 0, err
+		}
+
+		var frame ws.Frame
+		switch typ {
+		case "message":
+			payload, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return 0, err
+			}
+			frame = ws.NewBinaryFrame(payload)
+		case "close":
+			var reason struct {
+				Code   ws.StatusCode `json:"code"`
+				Reason string        `json:"reason"`
+			}
+			err = json.Unmarshal([]byte(data), &reason)
+			if err != nil {
+				return 0, err
+			}
+			body := binary.BigEndian.AppendUint16(nil, uint16(reason.Code))
+			frame = ws.NewCloseFrame(append(body, reason.Reason...))
+		default:
+			continue
+		}
+		_ = ws.WriteFrame(&es.buf, frame)
+	}
+	return es.buf.Read(p)
+}
+
+// next returns the type and data of the next event, comments are skipped.
+func (es *eventStream) next() (string, string, error) {
+	var (
+		typ  string
+		data []string
+	)
+	for {
+		line, err := es.br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if data == nil {
+				continue
+			}
+			if typ == "" {
+				typ = "message"
+			}
+			return typ, strings.Join(data, "\n"), nil
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			typ = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
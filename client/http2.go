@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
+	"golang.org/x/net/http2"
+)
+
+// dialHTTP2 opens a WebSocket with the extended CONNECT protocol of RFC 8441. The stream is the request body
+// in one direction and the response body in the other.
+func (d *dialer) dialHTTP2(ctx context.Context, u *url.URL) (*Conn, error) {
+	transport := &http2.Transport{
+		TLSClientConfig: d.tlsConfig,
+	}
+	if u.Scheme == "http" {
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	// the stream outlives ctx, which only applies to connecting
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodConnect, u.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = d.header.Clone()
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", ttyProtocol)
+	if d.compress {
+		var sb strings.Builder
+		_, _ = httphead.WriteOptions(&sb, []httphead.Option{wsflate.DefaultParameters.Option()})
+		req.Header.Set("Sec-WebSocket-Extensions", sb.String())
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if !stop() {
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		cancel()
+		transport.CloseIdleConnections()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		transport.CloseIdleConnections()
+		return nil, fmt.Errorf("ttyd: unexpected response status %s", resp.Status)
+	}
+
+	c := newConn(bufio.NewReader(resp.Body), pw, func() error {
+		_ = pw.Close()
+		err := resp.Body.Close()
+		cancel()
+		transport.CloseIdleConnections()
+		return err
+	})
+	if extensions := resp.Header.Get("Sec-WebSocket-Extensions"); extensions != "" {
+		options, _ := httphead.ParseOptions([]byte(extensions), nil)
+		c.negotiated(options)
+	}
+	return c, nil
+}
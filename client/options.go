@@ -0,0 +1,109 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+)
+
+// An Option configures how Dial connects to the server.
+type Option func(*dialer)
+
+// WithBasicAuth authenticates the requests to the server with HTTP basic auth.
+func WithBasicAuth(user, password string) Option {
+	return func(d *dialer) {
+		d.header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+}
+
+// WithHeader adds a header to the requests to the server, for example a bearer token checked by a reverse proxy.
+func WithHeader(key, value string) Option {
+	return func(d *dialer) {
+		d.header.Add(key, value)
+	}
+}
+
+// WithTLSConfig sets the TLS configuration for https and wss URLs, for example to trust a private CA or
+// to present a client certificate. The system roots are used by default.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(d *dialer) {
+		d.tlsConfig = config
+	}
+}
+
+// WithHTTP2 connects with the extended CONNECT protocol of HTTP/2 instead of the HTTP/1.1 upgrade.
+// For http and ws URLs, HTTP/2 without TLS is used with prior knowledge, which the server must allow.
+func WithHTTP2() Option {
+	return func(d *dialer) {
+		d.http2 = true
+	}
+}
+
+// WithEventStream connects with Server-Sent Events and POST requests instead of a WebSocket, for the networks
+// blocking WebSockets. The server must be served by ServeHTTP of ttyd. WithHTTP2 and WithCompression are ignored,
+// though HTTP/2 is used for https URLs if the server supports it.
+func WithEventStream() Option {
+	return func(d *dialer) {
+		d.eventStream = true
+	}
+}
+
+// WithCompression negotiates permessage-deflate with the server. The messages of the client are compressed
+// without context takeover, which costs some ratio but no memory between messages.
+func WithCompression() Option {
+	return func(d *dialer) {
+		d.compress = true
+	}
+}
+
+// WithSize sets the initial size of the terminal, which is 80 columns and 24 rows by default.
+func WithSize(columns, rows uint16) Option {
+	return func(d *dialer) {
+		d.columns = columns
+		d.rows = rows
+	}
+}
+
+// WithToken sends the token in the first message instead of fetching one.
+func WithToken(token string) Option {
+	return func(d *dialer) {
+		d.token = token
+		d.tokenSet = true
+	}
+}
+
+// WithTokenURL sets the URL to fetch the token from. By default, it's token relative to the WebSocket URL,
+// such as https://example.com/token for wss://example.com/ws. If the URL doesn't answer with the token in JSON,
+// such as on a server without the token endpoint, an empty token is sent.
+func WithTokenURL(url string) Option {
+	return func(d *dialer) {
+		d.tokenURL = url
+	}
+}
+
+// OnTitle sets the function called with the window title sent by the server. It's called from Read.
+func OnTitle(fn func(title string)) Option {
+	return func(d *dialer) {
+		d.onTitle = fn
+	}
+}
+
+// OnPreferences sets the function called with the terminal preferences sent by the server, such as
+// disableStdin when the client is read-only. It's called from Read.
+func OnPreferences(fn func(preferences map[string]any)) Option {
+	return func(d *dialer) {
+		d.onPreferences = fn
+	}
+}
+
+func newDialer(options []Option) *dialer {
+	d := &dialer{
+		header:  make(http.Header),
+		columns: 80,
+		rows:    24,
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+	"golang.org/x/term"
+)
+
+var (
+	basicAuth = flag.String("basic", "", "basic auth credential (user:password)")
+	header    = flag.String("header", "", "additional request header (name: value), such as the one checked by a reverse proxy")
+	caFile    = flag.String("ca", "", "path to the ca file to verify the server certificate with. the system roots are used if not provided")
+	cert      = flag.String("cert", "", "path to the tls client certificate file")
+	key       = flag.String("key", "", "path to the tls client key file")
+	insecure  = flag.Bool("insecure", false, "skip verifying the server certificate")
+	useHTTP2  = flag.Bool("http2", false, "connect with http/2 extended connect. http urls use http/2 without tls")
+	compress  = flag.Bool("compress", false, "negotiate compression")
+	useSSE    = flag.Bool("sse", false, "connect with server-sent events instead of a websocket, for networks blocking websockets")
+	tokenURL  = flag.String("token-url", "", "url to fetch the token from. token relative to the websocket url is used if not provided")
+	timeout   = flag.Duration("timeout", 10*time.Second, "time to wait for connecting")
+)
+
+func customError(msg string) {
+	_, _ = fmt.Fprintln(flag.CommandLine.Output(), msg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+func init() {
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		_, _ = fmt.Fprintln(flag.CommandLine.Output(), "the argument is the websocket url of the server")
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Example: %s ws://127.0.0.1:7681/ws\n", os.Args[0])
+	}
+	flag.Parse()
+	if len(flag.Args()) != 1 {
+		customError("exactly one url must be specified")
+	}
+	if *basicAuth != "" && strings.Count(*basicAuth, ":") != 1 {
+		customError("invalid basic auth. format user:password")
+	}
+	if *header != "" && !strings.Contains(*header, ":") {
+		customError("invalid header. format name: value")
+	}
+	if *cert == "" && *key != "" || *cert != "" && *key == "" {
+		customError("both cert and key must be provided")
+	}
+}
+
+func main() {
+	os.Exit(attach())
+}
+
+// attach proxies the terminal to the session, and returns the exit code of the process if it's reported.
+func attach() int {
+	options, err := dialOptions()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	tty := term.IsTerminal(stdin) && term.IsTerminal(stdout)
+	if tty {
+		if columns, rows, err := term.GetSize(stdout); err == nil {
+			options = append(options, client.WithSize(uint16(columns), uint16(rows)))
+		}
+		options = append(options, client.OnTitle(func(title string) {
+			_, _ = fmt.Fprintf(os.Stdout, "\x1b]0;%s\a", title)
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	conn, err := client.Dial(ctx, flag.Arg(0), options...)
+	cancel()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if tty {
+		state, err := term.MakeRaw(stdin)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer term.Restore(stdin, state)
+		stop := watchResize(conn, stdout)
+		defer stop()
+	}
+
+	// input keeps being forwarded until the session ends, even after stdin is exhausted
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+
+	var ce *client.CloseError
+	switch {
+	case err == nil:
+		ce = conn.CloseError()
+	case errors.As(err, &ce):
+	default:
+		_, _ = fmt.Fprint(os.Stderr, "\r\n", err, "\r\n")
+		return 1
+	}
+	if ce == nil {
+		_, _ = fmt.Fprint(os.Stderr, "\r\nconnection closed without a reason\r\n")
+		return 1
+	}
+	if code, ok := exitCode(ce.Reason); ok && ce.Code == 1000 {
+		return code
+	}
+	if ce.Reason != "" {
+		_, _ = fmt.Fprint(os.Stderr, "\r\nconnection closed: ", ce.Reason, "\r\n")
+	}
+	return 1
+}
+
+// exitCode returns the exit code of the process reported by the close reason, which is either exit status N, or
+// signal: X for processes killed by a signal, which are reported as 128 plus the signal number like shells do.
+func exitCode(reason string) (int, bool) {
+	if status, ok := strings.CutPrefix(reason, "exit status "); ok {
+		code, err := strconv.Atoi(status)
+		return code, err == nil
+	}
+	name, ok := strings.CutPrefix(reason, "signal: ")
+	if !ok {
+		return 0, false
+	}
+	name = strings.TrimSuffix(name, " (core dumped)")
+	// unknown signals are described with their numbers
+	if n, ok := strings.CutPrefix(name, "signal "); ok {
+		sig, err := strconv.Atoi(n)
+		return 128 + sig, err == nil && sig > 0
+	}
+	for sig := syscall.Signal(1); sig < 128; sig++ {
+		if sig.String() == name {
+			return 128 + int(sig), true
+		}
+	}
+	return 0, false
+}
+
+func dialOptions() ([]client.Option, error) {
+	var options []client.Option
+	if *basicAuth != "" {
+		user, password, _ := strings.Cut(*basicAuth, ":")
+		options = append(options, client.WithBasicAuth(user, password))
+	}
+	if *header != "" {
+		name, value, _ := strings.Cut(*header, ":")
+		options = append(options, client.WithHeader(strings.TrimSpace(name), strings.TrimSpace(value)))
+	}
+	if *useHTTP2 {
+		options = append(options, client.WithHTTP2())
+	}
+	if *useSSE {
+		options = append(options, client.WithEventStream())
+	}
+	if *compress {
+		options = append(options, client.WithCompression())
+	}
+	if *tokenURL != "" {
+		options = append(options, client.WithTokenURL(*tokenURL))
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: *insecure,
+	}
+	if *caFile != "" {
+		data, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found in " + *caFile)
+		}
+	}
+	if *cert != "" {
+		pair, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return append(options, client.WithTLSConfig(config)), nil
+}
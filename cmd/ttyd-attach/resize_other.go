@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+	"golang.org/x/term"
+)
+
+// watchResize reports the size of the terminal to the server when it changes, until stop is called.
+func watchResize(conn *client.Conn, fd int) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if columns, rows, err := term.GetSize(fd); err == nil {
+					_ = conn.Resize(uint16(columns), uint16(rows))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
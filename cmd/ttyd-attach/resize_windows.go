@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+// watchResize does nothing on windows, which has no SIGWINCH.
+func watchResize(*client.Conn, int) (stop func()) {
+	return func() {}
+}
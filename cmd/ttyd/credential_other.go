@@ -3,12 +3,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"flag"
+	"io"
 	"log"
+	"net/http"
+	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
+	"strings"
 	"syscall"
+
+	"github.com/WeidiDeng/ttyd-go"
 )
 
 var (
@@ -19,7 +28,8 @@ var (
 	trueGid int
 )
 
-func init() {
+// initCredential resolves the credential of the process. It must be called after the flags are parsed.
+func initCredential() {
 	flag.Visit(func(f *flag.Flag) {
 		switch f.Name {
 		case "uid":
@@ -67,3 +77,117 @@ func setCredential(cmd *exec.Cmd) {
 		cmd.SysProcAttr = attr
 	}
 }
+
+// account is the OS account a command runs as.
+type account struct {
+	name   string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	home   string
+	shell  string
+}
+
+// lookupAccount resolves the OS account of the authenticated user. Unknown users and the accounts below
+// the minimum uid, such as root and the system accounts, are rejected.
+func lookupAccount(name string) (*account, error) {
+	if name == "" {
+		return nil, &ttyd.StatusError{Code: http.StatusForbidden, Message: "no authenticated user"}
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return nil, &ttyd.StatusError{Code: http.StatusForbidden, Message: "no such os user"}
+		}
+		return nil, err
+	}
+
+	a := &account{
+		name:  u.Username,
+		home:  u.HomeDir,
+		shell: lookupShell(u.Username),
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 || id < uint64(max(*minUid, 0)) {
+		return nil, &ttyd.StatusError{Code: http.StatusForbidden, Message: "refusing to run as a system account"}
+	}
+	a.uid = uint32(id)
+	id, err = strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	a.gid = uint32(id)
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		id, err = strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		a.groups = append(a.groups, uint32(id))
+	}
+	return a, nil
+}
+
+// lookupShell returns the login shell of the user. It's looked up with getent, which goes through NSS like user.Lookup,
+// so that accounts from LDAP and the like have their shells too, or in /etc/passwd where getent isn't available.
+// /bin/sh is returned if neither has one.
+func lookupShell(name string) string {
+	out, err := exec.Command("getent", "passwd", name).Output()
+	if err == nil {
+		if shell := passwdShell(bytes.NewReader(out), name); shell != "" {
+			return shell
+		}
+	}
+
+	f, err := os.Open("/etc/passwd")
+	if err == nil {
+		defer f.Close()
+		if shell := passwdShell(f, name); shell != "" {
+			return shell
+		}
+	}
+	return "/bin/sh"
+}
+
+// passwdShell returns the shell of the user in the passwd entries read from r, or an empty string if there is none.
+func passwdShell(r io.Reader, name string) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name {
+			return fields[6]
+		}
+	}
+	return ""
+}
+
+// defaultPath is the PATH of the commands run as an account, the environment of the server isn't inherited.
+const defaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+// apply runs the command as the account in its home directory with a clean environment, so that the secrets
+// in the environment of the server don't leak to the users.
+func (a *account) apply(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    a.uid,
+			Gid:    a.gid,
+			Groups: a.groups,
+		},
+	}
+	cmd.Dir = a.home
+	cmd.Env = []string{
+		"HOME=" + a.home,
+		"USER=" + a.name,
+		"LOGNAME=" + a.name,
+		"SHELL=" + a.shell,
+		"PATH=" + defaultPath,
+		"TERM=xterm-256color",
+	}
+}
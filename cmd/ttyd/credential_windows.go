@@ -2,7 +2,24 @@
 
 package main
 
-import "os/exec"
+import (
+	"errors"
+	"os/exec"
+)
+
+func initCredential() {
+}
 
 func setCredential(cmd *exec.Cmd) {
 }
+
+type account struct {
+	shell string
+}
+
+func lookupAccount(string) (*account, error) {
+	return nil, errors.New("os user mapping is unavailable on windows")
+}
+
+func (a *account) apply(*exec.Cmd) {
+}
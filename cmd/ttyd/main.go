@@ -1,23 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/WeidiDeng/ttyd-go"
+	_ "github.com/WeidiDeng/ttyd-go/xconnect"
 )
 
 var (
 	address       = flag.String("addr", "127.0.0.1:7681", "address to listen on. use port 0 to select a random port")
 	socketAddress = flag.String("socket", "", "unix socket to listen on. this takes precedence over -addr")
 	basicAuth     = flag.String("basic", "", "basic auth credential (user:password)")
+	htpasswd      = flag.String("htpasswd", "", "path to the htpasswd file for basic auth with multiple users, with bcrypt, md5 (apr1), sha1, sha256 or sha512 hashes. reloaded on SIGHUP or change")
 	writable      = flag.Bool("writable", false, "enable writable mode")
 	compress      = flag.Bool("compress", false, "enable compression")
 	cert          = flag.String("cert", "", "path to the tls certificate file")
@@ -25,6 +37,44 @@ var (
 	uid           = flag.Int("uid", 0, "run as user id. unavailable on windows")
 	gid           = flag.Int("gid", 0, "run as group id. unavailable on windows")
 	cwd           = flag.String("cwd", "", "current working directory for the process. calling process's cwd is used if not provided")
+	recordDir     = flag.String("record", "", "directory to save asciicast recordings of sessions in")
+	recordInput   = flag.Bool("record-input", false, "also record client input. requires -record")
+	urlArg        = flag.Bool("url-arg", false, "allow clients to append arguments to the command with ?arg=foo&arg=bar")
+	argPattern    = flag.String("url-arg-pattern", "", "regular expression each url argument must fully match. requires -url-arg")
+	stopTimeout   = flag.Duration("shutdown-timeout", 10*time.Second, "time to wait for the processes to exit on SIGINT or SIGTERM before killing them")
+	maxClients    = flag.Int("max-clients", 0, "maximum number of clients connected at the same time. 0 means no limit")
+	once          = flag.Bool("once", false, "accept only one client and exit when it disconnects")
+	exitNoConn    = flag.Bool("exit-no-conn", false, "exit when all clients disconnect")
+	authHeader    = flag.String("auth-header", "", "http header name for the user authenticated by a reverse proxy. the user is passed to the command as TTYD_USER")
+	authProxy     = flag.String("auth-proxy", "127.0.0.1/32,::1/128", "comma separated cidrs of the reverse proxies trusted to set -auth-header")
+	checkOrigin   = flag.Bool("check-origin", false, "reject websocket connections from browsers on a different origin")
+	clientCA      = flag.String("ca", "", "path to the ca file to verify client certificates with. the certificate subject is used as the user. requires -cert")
+	writers       = flag.String("writable-users", "", "comma separated users allowed to write to the tty. others are read-only. overrides -writable")
+	osUser        = flag.Bool("os-user", false, "run the command as the os account of the authenticated user in its home directory with a clean environment. accounts below -os-user-min-uid are refused. unavailable on windows")
+	minUid        = flag.Int("os-user-min-uid", 1000, "lowest uid of the os accounts -os-user may run commands as, which excludes root and the system accounts. requires -os-user")
+	loginShell    = flag.Bool("login-shell", false, "run the login shell of the os account instead of the command. requires -os-user")
+	authFailures  = flag.Int("auth-failures", 10, "failed basic auth attempts allowed per minute per ip and per user before a temporary ban. 0 means no limit")
+	sessionRate   = flag.Int("session-rate", 0, "new sessions allowed per minute per ip and per user before a temporary ban. 0 means no limit")
+	banTime       = flag.Duration("ban", 5*time.Minute, "how long clients exceeding -auth-failures or -session-rate are banned")
+	auditLog      = flag.String("audit-log", "", "path to the json lines audit log of sessions with a hash chain")
+	auditInput    = flag.Bool("audit-input", false, "also record client input in the audit log. requires -audit-log")
+	auditKey      = flag.String("audit-key", "", "path to the file with the secret key of the hash chain of the audit log. without it, keep the hash of the last line elsewhere to detect rewriting. requires -audit-log")
+	auditMaxSize  = flag.Int64("audit-max-size", 100<<20, "size in bytes the audit log is rotated at. 0 disables rotation")
+	auditBackups  = flag.Int("audit-backups", 10, "number of rotated audit logs to keep")
+	allowCIDRs    = flag.String("allow", "", "comma separated ips or cidrs allowed to connect. all are allowed if empty")
+	denyCIDRs     = flag.String("deny", "", "comma separated ips or cidrs denied to connect. takes precedence over -allow")
+	h2c           = flag.Bool("h2c", false, "also serve http/2 without tls to clients with prior knowledge")
+	idleTimeout   = flag.Duration("idle-timeout", 0, "disconnect clients that send no input for the duration. 0 disables it")
+	outputTimeout = flag.Duration("output-timeout", 0, "disconnect clients that receive no output for the duration. 0 disables it")
+	maxDuration   = flag.Duration("max-duration", 0, "end sessions that have run for the duration. 0 disables it")
+	pingInterval  = flag.Duration("ping-interval", 0, "interval to send pings to clients at. 0 disables pings")
+	pongTimeout   = flag.Duration("pong-timeout", 0, "disconnect clients that don't answer a ping within the duration. requires -ping-interval")
+	multiplex     = flag.Bool("multiplex", false, "let clients serve many terminals over one websocket with the tty-mux subprotocol")
+	maxChannels   = flag.Int("max-channels", 16, "maximum number of terminals per multiplexed websocket. 0 means no limit. requires -multiplex")
+	trustedCIDRs  = flag.String("trusted-proxies", "", "comma separated ips or cidrs of the reverse proxies whose Forwarded or X-Forwarded-For headers are used to find the client ip for -allow, -deny, the client limits, rate limiting, -auth-failures and the audit log")
+
+	proxies []netip.Prefix
+	ipRules ttyd.IPRules
 )
 
 func customError(msg string) {
@@ -41,70 +91,289 @@ func init() {
 		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Example: %s /bin/bash -c 'echo hello world'\n", os.Args[0])
 	}
 	flag.Parse()
-	if len(flag.Args()) == 0 {
+	if len(flag.Args()) == 0 && !*loginShell {
 		customError("no command specified")
 	}
+	if *loginShell && !*osUser {
+		customError("login-shell requires os-user")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "os-user-min-uid" && !*osUser {
+			customError("os-user-min-uid requires os-user")
+		}
+	})
+	if *osUser && runtime.GOOS == "windows" {
+		customError("os-user is unavailable on windows")
+	}
+	initCredential()
 	if *basicAuth != "" && strings.Count(*basicAuth, ":") != 1 {
 		customError("invalid basic auth. format user:password")
 	}
 	if *cert == "" && *key != "" || *cert != "" && *key == "" {
 		customError("both cert and key must be provided")
 	}
+	var auths int
+	for _, auth := range []string{*basicAuth, *htpasswd, *authHeader, *clientCA} {
+		if auth != "" {
+			auths++
+		}
+	}
+	if auths > 1 {
+		customError("basic, htpasswd, auth-header and ca are mutually exclusive")
+	}
+	if *osUser && auths == 0 {
+		customError("os-user requires basic, htpasswd, auth-header or ca")
+	}
+	if *clientCA != "" && *cert == "" {
+		customError("ca requires cert and key")
+	}
+	if *authHeader != "" {
+		proxies = parsePrefixes("auth-proxy", *authProxy)
+	}
+	ipRules.Allow = parsePrefixes("allow", *allowCIDRs)
+	ipRules.Deny = parsePrefixes("deny", *denyCIDRs)
+	ipRules.TrustedProxies = parsePrefixes("trusted-proxies", *trustedCIDRs)
+	if *auditInput && *auditLog == "" {
+		customError("audit-input requires audit-log")
+	}
+	if *auditKey != "" && *auditLog == "" {
+		customError("audit-key requires audit-log")
+	}
+	if *pongTimeout > 0 && *pingInterval <= 0 {
+		customError("pong-timeout requires ping-interval")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "max-channels" && !*multiplex {
+			customError("max-channels requires multiplex")
+		}
+	})
+	if *recordInput && *recordDir == "" {
+		customError("record-input requires record")
+	}
+	if *argPattern != "" {
+		if !*urlArg {
+			customError("url-arg-pattern requires url-arg")
+		}
+		if _, err := regexp.Compile(*argPattern); err != nil {
+			customError("invalid url-arg-pattern: " + err.Error())
+		}
+	}
 }
 
 func main() {
-	cmdFunc := func() *exec.Cmd {
-		cmd := exec.Command(flag.Args()[0], flag.Args()[1:]...)
+	cmdFunc := func(r *http.Request) (*exec.Cmd, error) {
+		var acct *account
+		if *osUser {
+			var err error
+			acct, err = lookupAccount(ttyd.RequestUser(r))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var cmd *exec.Cmd
+		if *loginShell {
+			// a leading dash in argv[0] tells the shell to act as a login shell
+			cmd = &exec.Cmd{
+				Path: acct.shell,
+				Args: []string{"-" + filepath.Base(acct.shell)},
+			}
+		} else {
+			cmd = exec.Command(flag.Args()[0], flag.Args()[1:]...)
+		}
 		setCredential(cmd)
 		cmd.Dir = *cwd
-		return cmd
+		if acct != nil {
+			acct.apply(cmd)
+		}
+		return cmd, nil
 	}
 	now := time.Now()
-	var authFunc func(w http.ResponseWriter, r *http.Request) bool
-	if *basicAuth != "" {
-		user, pass, _ := strings.Cut(*basicAuth, ":")
-		authFunc = func(w http.ResponseWriter, r *http.Request) bool {
+	// authFunc returns the request carrying the authenticated user, or nil if the client is rejected
+	var (
+		authFunc func(w http.ResponseWriter, r *http.Request) *http.Request
+		tokens   *ttyd.TokenAuth
+	)
+	switch {
+	case *basicAuth != "" || *htpasswd != "":
+		var check func(user, pass string) bool
+		if *basicAuth != "" {
+			user, pass, _ := strings.Cut(*basicAuth, ":")
+			check = func(u, p string) bool {
+				return subtle.ConstantTimeCompare([]byte(u), []byte(user))&subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+			}
+		} else {
+			users, err := ttyd.LoadHtpasswd(*htpasswd)
+			if err != nil {
+				log.Fatalln("failed to load htpasswd:", err)
+			}
+			go reloadOnHangup(users)
+			check = users.Authenticate
+		}
+		var failures *ttyd.TokenBucket
+		if *authFailures > 0 {
+			failures = ttyd.NewTokenBucket(float64(*authFailures)/60, *authFailures, *banTime)
+		}
+		authFunc = func(w http.ResponseWriter, r *http.Request) *http.Request {
 			u, p, ok := r.BasicAuth()
-			if !ok || u != user || p != pass {
+			keys := []string{"ip:" + ttyd.RequestClientIP(r)}
+			if u != "" {
+				keys = append(keys, "user:"+u)
+			}
+			if failures != nil {
+				if allowed, retryAfter := failures.Check(keys...); !allowed {
+					ttyd.TooManyRequests(w, retryAfter)
+					return nil
+				}
+			}
+			if !ok || !check(u, p) {
+				// requests without credentials are how browsers ask for them, not failed attempts
+				if ok && failures != nil {
+					failures.Allow(keys...)
+				}
 				w.Header().Set("WWW-Authenticate", `Basic realm="ttyd"`)
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-				return false
+				return nil
 			}
-			return true
+			return ttyd.RequestWithUser(r, u)
 		}
-	} else {
-		authFunc = func(w http.ResponseWriter, r *http.Request) bool {
-			return true
+	case *clientCA != "":
+		authFunc = func(w http.ResponseWriter, r *http.Request) *http.Request {
+			user := certUser(r)
+			if user == "" {
+				http.Error(w, "no user in client certificate", http.StatusForbidden)
+				return nil
+			}
+			return ttyd.RequestWithUser(r, user)
+		}
+	case *authHeader != "":
+		authFunc = func(w http.ResponseWriter, r *http.Request) *http.Request {
+			var authenticated *http.Request
+			ttyd.AuthHeader(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				authenticated = r
+			}), *authHeader, proxies...).ServeHTTP(w, r)
+			return authenticated
+		}
+	default:
+		authFunc = func(w http.ResponseWriter, r *http.Request) *http.Request {
+			return r
 		}
 	}
+	if *basicAuth != "" || *htpasswd != "" || *clientCA != "" || *authHeader != "" {
+		// the websockets must carry a token issued to the same user
+		tokens = ttyd.NewTokenAuth(nil, 0)
+	}
 	http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		if !authFunc(writer, request) {
+		if request = authFunc(writer, request); request == nil {
 			return
 		}
 
 		http.ServeContent(writer, request, "index.html", now, strings.NewReader(ttyd.DefaultHTML))
 	})
 	http.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
-		if !authFunc(writer, request) {
+		if request = authFunc(writer, request); request == nil {
 			return
 		}
 
+		if tokens != nil {
+			tokens.ServeHTTP(writer, request)
+			return
+		}
 		ttyd.DefaultTokenHandlerFunc(writer, request)
 	})
 
+	var handlerOptions []ttyd.HandlerOption
+	if *writable {
+		handlerOptions = append(handlerOptions, ttyd.EnableClientInput())
+	}
+	if *compress {
+		handlerOptions = append(handlerOptions, ttyd.EnableCompressionWithContextTakeover())
+	}
+	if *recordDir != "" {
+		handlerOptions = append(handlerOptions, ttyd.EnableRecording(ttyd.DirRecordingSink(*recordDir), *recordInput))
+	}
+	if *urlArg {
+		var validate ttyd.ArgValidator
+		if *argPattern != "" {
+			validate = ttyd.MatchArgs(*argPattern)
+		}
+		handlerOptions = append(handlerOptions, ttyd.EnableURLArgs(validate))
+	}
+	if *writers != "" {
+		users := make(map[string]bool)
+		for _, user := range strings.Split(*writers, ",") {
+			users[strings.TrimSpace(user)] = true
+		}
+		handlerOptions = append(handlerOptions, ttyd.WithWritableFunc(func(r *http.Request) bool {
+			user := ttyd.RequestUser(r)
+			return user != "" && users[user]
+		}))
+	}
+	if *auditLog != "" {
+		var key []byte
+		if *auditKey != "" {
+			var err error
+			key, err = os.ReadFile(*auditKey)
+			if err != nil {
+				log.Fatalln("failed to read audit key:", err)
+			}
+			key = bytes.TrimSpace(key)
+			if len(key) == 0 {
+				log.Fatalln("audit key is empty")
+			}
+		}
+		sink, err := ttyd.NewAuditLog(*auditLog, *auditMaxSize, *auditBackups, key)
+		if err != nil {
+			log.Fatalln("failed to open audit log:", err)
+		}
+		sink.OnError(func(err error) {
+			log.Println("failed to write audit log:", err)
+		})
+		defer sink.Close()
+		handlerOptions = append(handlerOptions, ttyd.WithAuditSink(sink, *auditInput))
+	}
+	if *sessionRate > 0 {
+		handlerOptions = append(handlerOptions, ttyd.WithRateLimiter(ttyd.NewTokenBucket(float64(*sessionRate)/60, *sessionRate, *banTime)))
+	}
+	if *idleTimeout > 0 || *outputTimeout > 0 {
+		handlerOptions = append(handlerOptions, ttyd.WithIdleTimeout(*idleTimeout, *outputTimeout))
+	}
+	if *maxDuration > 0 {
+		handlerOptions = append(handlerOptions, ttyd.WithMaxDuration(*maxDuration))
+	}
+	if *pingInterval > 0 {
+		handlerOptions = append(handlerOptions, ttyd.WithPingInterval(*pingInterval), ttyd.WithPongTimeout(*pongTimeout))
+	}
+	if *multiplex {
+		handlerOptions = append(handlerOptions, ttyd.EnableMultiplexing(*maxChannels))
+	}
+	if *checkOrigin {
+		handlerOptions = append(handlerOptions, ttyd.CheckOrigin())
+	}
+	if tokens != nil {
+		handlerOptions = append(handlerOptions, ttyd.EnableTokenAuth(tokens))
+	}
+	if *once {
+		handlerOptions = append(handlerOptions, ttyd.WithMaxClients(1))
+	} else if *maxClients > 0 {
+		handlerOptions = append(handlerOptions, ttyd.WithMaxClients(*maxClients))
+	}
+	stop := make(chan struct{}, 1)
+	if *once || *exitNoConn {
+		handlerOptions = append(handlerOptions, ttyd.OnIdle(func() {
+			select {
+			case stop <- struct{}{}:
+			default:
+			}
+		}))
+	}
+	handler := ttyd.NewCommandHandler(cmdFunc, handlerOptions...)
 	http.HandleFunc("/ws", func(writer http.ResponseWriter, request *http.Request) {
-		if !authFunc(writer, request) {
+		if request = authFunc(writer, request); request == nil {
 			return
 		}
 
-		var handlerOptions []ttyd.HandlerOption
-		if *writable {
-			handlerOptions = append(handlerOptions, ttyd.EnableClientInput())
-		}
-		if *compress {
-			handlerOptions = append(handlerOptions, ttyd.EnableCompressionWithContextTakeover())
-		}
-		ttyd.NewHandler(cmdFunc(), handlerOptions...).ServeHTTP(writer, request)
+		handler.ServeHTTP(writer, request)
 	})
 	var (
 		network   string
@@ -130,8 +399,80 @@ func main() {
 	if printAddr {
 		log.Println("listening on", l.Addr().String())
 	}
+
+	srv := &http.Server{}
+	if err = ttyd.ConfigureHTTP2(srv, *h2c); err != nil {
+		log.Println("websockets over http/2 are disabled:", err)
+	}
+	if len(ipRules.Allow) > 0 || len(ipRules.Deny) > 0 || len(ipRules.TrustedProxies) > 0 {
+		srv.Handler = ttyd.FilterIP(http.DefaultServeMux, ipRules)
+	}
+	if *clientCA != "" {
+		srv.TLSConfig, err = clientCAConfig(*clientCA)
+		if err != nil {
+			log.Fatalln("failed to load ca:", err)
+		}
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sig:
+		case <-stop:
+		}
+		signal.Stop(sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *stopTimeout)
+		defer cancel()
+		go func() {
+			_ = srv.Shutdown(ctx)
+		}()
+		err := handler.Shutdown(ctx, "server shutting down")
+		if err != nil {
+			log.Println("processes killed after shutdown timeout")
+		}
+	}()
+
 	if *cert != "" {
-		log.Fatal(http.ServeTLS(l, nil, *cert, *key))
+		err = srv.ServeTLS(l, *cert, *key)
+	} else {
+		err = srv.Serve(l)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+}
+
+// reloadOnHangup reloads the htpasswd file when SIGHUP is received.
+func reloadOnHangup(users *ttyd.Htpasswd) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := users.Reload(); err != nil {
+			log.Println("failed to reload htpasswd:", err)
+		}
+	}
+}
+
+// parsePrefixes parses the comma separated ips or cidrs of the flag.
+func parsePrefixes(name, value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(cidr)
+			if ipErr != nil {
+				customError("invalid " + name + ": " + err.Error())
+			}
+			prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		prefixes = append(prefixes, prefix)
 	}
-	log.Fatal(http.Serve(l, nil))
+	return prefixes
 }
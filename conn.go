@@ -7,7 +7,10 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsflate"
@@ -15,6 +18,10 @@ import (
 
 var errFrameTooLarge = errors.New("frame too large")
 
+// closeTimeout is how long writing the close frame may take. The write deadline also unblocks the writes
+// in progress to clients that stopped reading.
+const closeTimeout = 5 * time.Second
+
 type flateReader interface {
 	io.ReadCloser
 	flate.Resetter
@@ -38,16 +45,52 @@ type wsConn struct {
 
 	hdr  ws.Header
 	lock sync.Mutex
+
+	// pinged is the time in unix nanoseconds of the oldest ping not answered yet, or zero
+	pinged atomic.Int64
 }
 
 func (w *wsConn) Close() {
+	_ = w.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
 	w.lock.Lock()
 	_, _ = w.conn.Write(ws.CompiledCloseNormalClosure)
 	w.lock.Unlock()
 	_ = w.conn.Close()
 }
 
+func (w *wsConn) CloseWithStatus(code ws.StatusCode, reason string) {
+	_ = w.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	w.lock.Lock()
+	_ = ws.WriteFrame(w.brw, ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+	_ = w.brw.Flush()
+	w.lock.Unlock()
+	_ = w.conn.Close()
+}
+
+// closeError closes the connection that won't be served with the close code and text of the error.
+func closeError(conn net.Conn, brw *bufio.ReadWriter, err error) {
+	c := &wsConn{
+		brw:  brw,
+		conn: conn,
+	}
+	code, msg := errorStatus(err)
+	c.CloseWithStatus(closeStatus(code), msg)
+}
+
+// closeStatus maps an HTTP status code to the WebSocket close code with the closest meaning.
+func closeStatus(code int) ws.StatusCode {
+	switch {
+	case code == http.StatusServiceUnavailable:
+		return ws.StatusGoingAway
+	case code >= 400 && code < 500:
+		return ws.StatusPolicyViolation
+	default:
+		return ws.StatusInternalServerError
+	}
+}
+
 func (w *wsConn) Ping() error {
+	w.pinged.CompareAndSwap(0, time.Now().UnixNano())
 	w.lock.Lock()
 	_, err := w.conn.Write(ws.CompiledPing)
 	w.lock.Unlock()
@@ -67,6 +110,8 @@ func (w *wsConn) handleControl(hdr ws.Header) error {
 		_ = ws.WriteFrame(w.brw, ws.NewPongFrame(data))
 		err = w.brw.Flush()
 		w.lock.Unlock()
+	case ws.OpPong:
+		w.pinged.Store(0)
 	case ws.OpClose:
 		err = io.EOF
 	}
@@ -144,8 +189,8 @@ func (w *wsConn) readFrame(limit int64) error {
 }
 
 func (w *wsConn) Write(p []byte) (n int, err error) {
-	w.wb.Reset()
 	w.lock.Lock()
+	w.wb.Reset()
 	var frame ws.Frame
 	if !w.accepted {
 		frame = ws.NewBinaryFrame(p)
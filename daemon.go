@@ -1,11 +1,15 @@
 package ttyd
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
+	"log"
+	"net/http"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,38 +17,212 @@ import (
 	"github.com/gobwas/ws"
 )
 
+var errInvalidMessage = errors.New("invalid message")
+
+// maxQueued is how many bytes of output may be queued for a client before broadcasting waits for it.
+const maxQueued = 1 << 20
+
+// stallTimeout is how long broadcasting waits for a client to drain its queue or to resume when other clients share
+// its session. Clients that take longer are dropped, or no longer waited for if they are paused, so that a stalled
+// client can't freeze the output of the others. A client alone in its session is waited for as long as it takes.
+const stallTimeout = 10 * time.Second
+
+// internalError is an error of the server rather than the client.
+type internalError struct {
+	err error
+}
+
+func (e *internalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *internalError) Unwrap() error {
+	return e.err
+}
+
 type daemon struct {
-	conn *wsConn
-	cmd  *exec.Cmd
-	file *os.File
+	conn    *wsConn
+	session *session
+	size    pty.Winsize
+	sized   bool
 
 	paused atomic.Bool
 	resume chan struct{}
 	ioErr  atomic.Bool
+	reason TerminationReason
 
-	writable         bool
+	writable         atomic.Bool
 	options          map[string]any
 	messageSizeLimit int64
 	title            string
+	tokens           *TokenAuth
+	user             string
+	remoteAddr       string
+
+	since     time.Time
+	lastInput atomic.Int64
+	expired   atomic.Bool
+	timeout   TerminationReason
+
+	// the output is queued and written by writeLoop, which also writes the close frame after the queued output
+	outLock   sync.Mutex
+	queue     [][]byte
+	queued    int
+	ready     chan struct{}
+	space     chan struct{}
+	closing   chan struct{}
+	written   chan struct{}
+	closeCode ws.StatusCode
+	closeText string
 }
 
-func (d *daemon) cleanup() {
+// close closes the connection with the close code and text after the queued output is written, and detaches
+// the client from its session. reason is used if the session ends because of this client.
+func (d *daemon) close(reason TerminationReason, code ws.StatusCode, text string) {
 	if d.ioErr.CompareAndSwap(false, true) {
-		d.conn.Close()
-		if d.file != nil {
-			_ = d.file.Close()
-			_ = d.cmd.Wait()
+		d.reason = reason
+		d.closeCode = code
+		d.closeText = text
+		// the output before the close frame, such as the last words of the process, is still written in time,
+		// and a write in progress to a client that stopped reading fails by then
+		_ = d.conn.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		close(d.closing)
+		if d.session != nil {
+			d.audit(AuditDisconnect, nil)
+			d.session.detach(d)
+		}
+	}
+}
+
+// enqueue queues the message for writeLoop, p mustn't be modified afterward. Unless force is true, it fails
+// if maxQueued bytes are already queued.
+func (d *daemon) enqueue(p []byte, force bool) bool {
+	d.outLock.Lock()
+	if !force && d.queued >= maxQueued {
+		d.outLock.Unlock()
+		return false
+	}
+	d.queue = append(d.queue, p)
+	d.queued += len(p)
+	d.outLock.Unlock()
+
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// notify queues the message unless the client hasn't reported its size, as it may be writing the initial messages
+// then. The session lock must be held.
+func (d *daemon) notify(p []byte) {
+	if d.sized {
+		d.enqueue(p, false)
+	}
+}
+
+// drop closes the client that stalled its shared session, the output queued for it is discarded. The close frame
+// is only received if the client reads again before the write in progress times out.
+func (d *daemon) drop() {
+	d.outLock.Lock()
+	d.queue = nil
+	d.queued = 0
+	d.outLock.Unlock()
+	d.close(ReasonStalled, ws.StatusPolicyViolation, "client too slow")
+}
+
+// writeLoop writes the queued output until the client is closed, and then the close frame.
+func (d *daemon) writeLoop() {
+	defer close(d.written)
+	for {
+		select {
+		case <-d.ready:
+			if !d.flush() {
+				return
+			}
+		case <-d.closing:
+			d.flush()
+			if d.closeCode == ws.StatusNormalClosure && d.closeText == "" {
+				d.conn.Close()
+			} else {
+				d.conn.CloseWithStatus(d.closeCode, d.closeText)
+			}
+			return
 		}
 	}
 }
 
+// flush writes the queued output. It closes the connection and returns false if a write fails.
+func (d *daemon) flush() bool {
+	for {
+		d.outLock.Lock()
+		queue := d.queue
+		d.queue = nil
+		d.queued = 0
+		d.outLock.Unlock()
+		if len(queue) == 0 {
+			return true
+		}
+		select {
+		case d.space <- struct{}{}:
+		default:
+		}
+
+		for _, p := range queue {
+			_, err := d.conn.Write(p)
+			if err != nil {
+				// readLoop will fail and detach the client
+				_ = d.conn.conn.Close()
+				return false
+			}
+		}
+	}
+}
+
+// closeError closes the connection with the close code and text describing the error that ends readLoop.
+func (d *daemon) closeError(err error) {
+	var (
+		pe ws.ProtocolError
+		ie *internalError
+	)
+	switch {
+	case d.expired.Load():
+		// readLoop is interrupted by watchLoop, the clients closed normally aren't reconnected by the frontend
+		code := ws.StatusNormalClosure
+		if d.timeout == ReasonPongTimeout {
+			code = ws.StatusGoingAway
+		}
+		d.close(d.timeout, code, d.timeout.String())
+		if d.timeout == ReasonTimeLimit {
+			d.session.end(ReasonTimeLimit)
+		}
+	case err == nil:
+		d.close(ReasonClientClose, ws.StatusNormalClosure, "")
+	case errors.Is(err, errFrameTooLarge):
+		d.close(ReasonFrameTooLarge, ws.StatusMessageTooBig, err.Error())
+	case errors.As(err, &pe), errors.Is(err, errInvalidMessage):
+		d.close(ReasonProtocolError, ws.StatusProtocolError, err.Error())
+	case errors.Is(err, errInvalidToken), errors.Is(err, errTokenExpired), errors.Is(err, errTokenUsed):
+		d.close(ReasonUnauthorized, ws.StatusPolicyViolation, err.Error())
+	case errors.Is(err, errSessionClosed):
+		d.close(ReasonProcessExit, ws.StatusGoingAway, err.Error())
+	case errors.As(err, &ie):
+		// the error may reveal details of the server such as paths, so the client only gets the status text like
+		// the HTTP errors of errorStatus
+		log.Printf("ttyd: serving %s: %v", d.remoteAddr, ie.err)
+		d.close(ReasonServerError, ws.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	default:
+		d.close(ReasonClientClose, ws.StatusNormalClosure, "")
+	}
+}
+
 func (d *daemon) initWrite() error {
 	d.conn.wb.WriteByte(setWindowTitle)
 	if d.title != "" {
 		d.conn.wb.WriteString(d.title)
 	} else {
 		hostname, _ := os.Hostname()
-		d.conn.wb.WriteString(strings.Join(d.cmd.Args, " "))
+		d.conn.wb.WriteString(strings.Join(d.session.cmd.Args, " "))
 		d.conn.wb.WriteString(" (")
 		d.conn.wb.WriteString(hostname)
 		d.conn.wb.WriteByte(')')
@@ -65,59 +243,69 @@ func (d *daemon) initWrite() error {
 	return err
 }
 
-func (d *daemon) readLoop() {
+// nextMessage reads the next non-empty message, and returns its type. The rest of the message is left in rb.
+func (d *daemon) nextMessage() (byte, error) {
+	d.conn.rb.Reset()
+	for d.conn.rb.Len() == 0 {
+		err := d.conn.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		err = d.conn.readFrame(d.messageSizeLimit)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return d.conn.rb.ReadByte()
+}
+
+// readLoop handles client messages until an error occurs. The error is returned to decide the termination reason.
+func (d *daemon) readLoop() error {
 	err := d.initWrite()
 	if err != nil {
-		return
+		return err
 	}
-	d.conn.lr.R = d.conn.brw
+	var cmd byte
 	for !d.ioErr.Load() {
-		d.conn.rb.Reset()
-		for d.conn.rb.Len() == 0 {
-			err = d.conn.nextFrame()
-			if err != nil {
-				return
-			}
-
-			err = d.conn.readFrame(d.messageSizeLimit)
-			if err != nil {
-				return
-			}
+		cmd, err = d.nextMessage()
+		if err != nil {
+			return err
 		}
 
-		cmd, _ := d.conn.rb.ReadByte()
-		if (cmd == jsonData && d.file != nil) || (cmd != jsonData && d.file == nil) {
+		if (cmd == jsonData && d.sized) || (cmd != jsonData && !d.sized) {
 			continue
 		}
 
 		switch cmd {
 		case input:
-			if d.writable {
-				_, err = d.conn.rb.WriteTo(d.file)
+			d.lastInput.Store(time.Now().UnixNano())
+			if d.writable.Load() {
+				if d.session.recorder != nil {
+					d.session.recorder.inputData(d.conn.rb.Bytes())
+				}
+				if d.session.h.auditInput {
+					d.audit(AuditInput, bytes.Clone(d.conn.rb.Bytes()))
+				}
+				// write errors mean the process is exiting, the session will close the client with its exit status
+				n, _ := d.conn.rb.WriteTo(d.session.file)
+				d.session.bytesIn.Add(n)
 			} else {
-				_, err = d.conn.rb.WriteTo(io.Discard)
-			}
-			if err != nil {
-				return
+				_, _ = d.conn.rb.WriteTo(io.Discard)
 			}
 		case resizeTerminal:
 			var rr resizeRequest
 			err = json.NewDecoder(&d.conn.rb).Decode(&rr)
 			if err != nil {
-				return
+				return errInvalidMessage
 			}
 
-			err = pty.Setsize(d.file, &pty.Winsize{
+			err = d.session.setSize(d, pty.Winsize{
 				Rows: rr.Rows,
 				Cols: rr.Columns,
 			})
 			if err != nil {
-				return
-			}
-
-			err = setNonblock(d.file)
-			if err != nil {
-				return
+				return &internalError{err}
 			}
 		case pause:
 			d.paused.Store(true)
@@ -129,61 +317,25 @@ func (d *daemon) readLoop() {
 			}
 		case jsonData:
 			_ = d.conn.rb.UnreadByte()
-			var rr resizeRequest
+			var rr initRequest
 			err = json.NewDecoder(&d.conn.rb).Decode(&rr)
 			if err != nil {
-				return
+				return errInvalidMessage
 			}
 
-			d.file, err = pty.StartWithSize(d.cmd, &pty.Winsize{
-				Rows: rr.Rows,
-				Cols: rr.Columns,
-			})
+			err = d.verifyToken(rr.AuthToken)
 			if err != nil {
-				return
+				return err
 			}
 
-			err = setNonblock(d.file)
+			err = d.session.setSize(d, pty.Winsize{
+				Rows: rr.Rows,
+				Cols: rr.Columns,
+			})
 			if err != nil {
-				return
+				return &internalError{err}
 			}
-			go d.writeLoop()
-		}
-	}
-}
-
-func (d *daemon) writeLoop() {
-	d.conn.wb.Grow(d.conn.brw.Writer.Size() - ws.MaxHeaderSize)
-	buf := d.conn.wb.Bytes()[:d.conn.wb.Cap()]
-	for !d.ioErr.Load() {
-		buf[0] = output
-		n, err := d.file.Read(buf[1:])
-		if err != nil {
-			break
-		}
-
-		_, err = d.conn.Write(buf[:1+n])
-		if err != nil {
-			break
-		}
-
-		if d.paused.Load() {
-			<-d.resume
-		}
-	}
-	d.cleanup()
-}
-
-func (d *daemon) pingLoop(ticker *time.Ticker, done chan struct{}) {
-	var err error
-	for !d.ioErr.Load() && err == nil {
-		select {
-		case <-ticker.C:
-			err = d.conn.Ping()
-		case <-done:
-			err = io.EOF
 		}
 	}
-	ticker.Stop()
-	d.cleanup()
+	return nil
 }
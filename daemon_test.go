@@ -0,0 +1,32 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestInternalErrorHidden(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	dir := t.TempDir() + "/missing"
+	h := NewCommandHandler(shell("echo hello"), EnableRecording(DirRecordingSink(dir), false))
+	_, ce := readAll(t, dial(t, startServer(t, h)))
+	if ce == nil || ce.Code != ws.StatusInternalServerError || ce.Reason != http.StatusText(http.StatusInternalServerError) {
+		t.Fatalf("failing to start the session closed with %v", ce)
+	}
+	if !strings.Contains(logged.String(), dir) {
+		t.Fatalf("the error isn't logged: %q", logged.String())
+	}
+}
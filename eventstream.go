@@ -0,0 +1,256 @@
+package ttyd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// EventStreamParam is the query parameter carrying the stream ID of the messages POSTed to an event stream.
+const EventStreamParam = "stream"
+
+var (
+	errNoStream      = &StatusError{Code: http.StatusNotFound, Message: "stream not found"}
+	errStreamClosed  = &StatusError{Code: http.StatusGone, Message: "stream closed"}
+	errInputTooLarge = &StatusError{Code: http.StatusRequestEntityTooLarge, Message: errFrameTooLarge.Error()}
+)
+
+// eventStreams are the event streams of a handler by their IDs.
+type eventStreams struct {
+	lock    sync.Mutex
+	streams map[string]*eventStream
+}
+
+// eventStream carries the ttyd protocol over Server-Sent Events and POST requests. It's one end of a pipe,
+// the other end is fed with the POSTed messages as masked WebSocket frames, and the WebSocket frames written
+// by the daemon are read from it and sent as events, so the daemon serves it like a WebSocket connection.
+type eventStream struct {
+	net.Conn
+	peer       net.Conn
+	w          http.ResponseWriter
+	localAddr  net.Addr
+	remoteAddr *http2Addr
+
+	id   string
+	user string
+	h    *Handler
+	done chan struct{}
+}
+
+// isEventStream reports whether the request asks for an event stream instead of a WebSocket.
+func isEventStream(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// upgradeEventStream starts the event stream with additional response header. The first event is a stream event
+// with the stream ID the messages of the client are POSTed with.
+func (h *Handler) upgradeEventStream(w http.ResponseWriter, r *http.Request, header http.Header) (net.Conn, *bufio.ReadWriter, ws.Handshake, error) {
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// disable the response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	conn, peer := net.Pipe()
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if localAddr == nil {
+		localAddr = conn.LocalAddr()
+	}
+	es := &eventStream{
+		Conn:      conn,
+		peer:      peer,
+		w:         w,
+		localAddr: localAddr,
+		remoteAddr: &http2Addr{
+			network: localAddr.Network(),
+			addr:    r.RemoteAddr,
+		},
+		id:   newSessionID(),
+		user: RequestUser(r),
+		h:    h,
+		done: make(chan struct{}),
+	}
+
+	_, err := io.WriteString(w, "event: stream\ndata: "+es.id+"\n\n")
+	if err == nil {
+		err = http.NewResponseController(w).Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		_ = peer.Close()
+		return nil, nil, ws.Handshake{}, err
+	}
+
+	h.streams.lock.Lock()
+	if h.streams.streams == nil {
+		h.streams.streams = make(map[string]*eventStream)
+	}
+	h.streams.streams[es.id] = es
+	h.streams.lock.Unlock()
+
+	go es.writeLoop()
+	return es, bufio.NewReadWriter(bufio.NewReader(es), bufio.NewWriter(es)), ws.Handshake{Protocol: ttyProtocol}, nil
+}
+
+// writeLoop sends the frames written by the daemon as events until the pipe is closed or the client is gone.
+// Each message is a message event with the message in base64, pings are comments, and the close frame
+// is a close event with the close code and reason in JSON.
+func (es *eventStream) writeLoop() {
+	defer close(es.done)
+	defer es.h.removeStream(es)
+	// writes of the daemon fail instead of blocking once the client can't be written to
+	defer es.peer.Close()
+
+	br := bufio.NewReader(es.peer)
+	rc := http.NewResponseController(es.w)
+	var event []byte
+	for {
+		frame, err := ws.ReadFrame(br)
+		if err != nil {
+			return
+		}
+
+		event = event[:0]
+		switch frame.Header.OpCode {
+		case ws.OpPing:
+			event = append(event, ": ping\n\n"...)
+		case ws.OpClose:
+			var reason struct {
+				Code   ws.StatusCode `json:"code"`
+				Reason string        `json:"reason"`
+			}
+			reason.Code = ws.StatusNoStatusRcvd
+			if len(frame.Payload) >= 2 {
+				reason.Code = ws.StatusCode(binary.BigEndian.Uint16(frame.Payload))
+				reason.Reason = string(frame.Payload[2:])
+			}
+			data, _ := json.Marshal(reason)
+			event = append(event, "event: close\ndata: "...)
+			event = append(event, data...)
+			event = append(event, "\n\n"...)
+		default:
+			event = append(event, "data: "...)
+			event = base64.StdEncoding.AppendEncode(event, frame.Payload)
+			event = append(event, "\n\n"...)
+		}
+
+		_, err = es.w.Write(event)
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+
+		if frame.Header.OpCode == ws.OpPing {
+			// the client is alive as long as the events can be written, and the pong mustn't wait for readLoop
+			go es.input(ws.OpPong, nil)
+		}
+	}
+}
+
+// input writes the message to the daemon as a masked frame, which returns after the daemon reads it.
+func (es *eventStream) input(op ws.OpCode, p []byte) error {
+	return writeClientFrame(es.peer, op, p)
+}
+
+// writeClientFrame writes the message to the pipe as a masked frame with a single write.
+func writeClientFrame(conn net.Conn, op ws.OpCode, p []byte) error {
+	var buf bytes.Buffer
+	err := ws.WriteFrame(&buf, ws.MaskFrameInPlace(ws.NewFrame(op, true, p)))
+	if err != nil {
+		return err
+	}
+	// writes to a pipe are atomic, concurrent frames aren't interleaved
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func (es *eventStream) LocalAddr() net.Addr {
+	return es.localAddr
+}
+
+func (es *eventStream) RemoteAddr() net.Addr {
+	return es.remoteAddr
+}
+
+// Close closes the pipe and waits for the events written so far to be sent, as the response can't be written to
+// after the handler returns.
+func (es *eventStream) Close() error {
+	err := es.Conn.Close()
+	<-es.done
+	return err
+}
+
+func (es *eventStream) SetDeadline(t time.Time) error {
+	err := es.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return es.SetWriteDeadline(t)
+}
+
+// SetWriteDeadline also applies to sending the events, so that clients that stopped reading can't block
+// the daemon forever.
+func (es *eventStream) SetWriteDeadline(t time.Time) error {
+	_ = http.NewResponseController(es.w).SetWriteDeadline(t)
+	return es.Conn.SetWriteDeadline(t)
+}
+
+func (h *Handler) removeStream(es *eventStream) {
+	h.streams.lock.Lock()
+	delete(h.streams.streams, es.id)
+	h.streams.lock.Unlock()
+}
+
+// serveEventInput writes the message POSTed by the client of an event stream to its daemon.
+// The stream can only be written to by the user that started it.
+func (h *Handler) serveEventInput(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		http.Error(w, errForbiddenOrigin.Message, errForbiddenOrigin.Code)
+		return
+	}
+
+	h.streams.lock.Lock()
+	es := h.streams.streams[r.URL.Query().Get(EventStreamParam)]
+	h.streams.lock.Unlock()
+	if es == nil || es.user != RequestUser(r) {
+		http.Error(w, errNoStream.Message, errNoStream.Code)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if h.messageSizeLimit > 0 {
+		body = io.LimitReader(r.Body, h.messageSizeLimit+1)
+	}
+	p, err := io.ReadAll(body)
+	if err != nil {
+		return
+	}
+	if h.messageSizeLimit > 0 && int64(len(p)) > h.messageSizeLimit {
+		http.Error(w, errInputTooLarge.Message, errInputTooLarge.Code)
+		return
+	}
+
+	if len(p) > 0 {
+		err = es.input(ws.OpBinary, p)
+		if err != nil {
+			http.Error(w, errStreamClosed.Message, errStreamClosed.Code)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
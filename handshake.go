@@ -3,11 +3,17 @@ package ttyd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
 	"io"
 	"net"
+	"net/netip"
+	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"compress/flate"
@@ -27,51 +33,194 @@ var DefaultHTML string
 // DefaultTokenHandlerFunc is used to serve the default token for the ttyd server.
 // ttyd protocol requires a token to be sent in the first message, but there are
 // other ways to authenticate the client, such as using the URL query parameters
-// and standard HTTP authentications.
+// and standard HTTP authentications. Use TokenAuth to issue and verify real tokens.
 func DefaultTokenHandlerFunc(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	_, _ = io.WriteString(w, "{\"token\": \"\"}")
 }
 
-func wsProtocol(string) bool {
-	return true
+func wsProtocol(protocol string) bool {
+	return protocol == ttyProtocol
+}
+
+// A CommandFunc returns the command to run for a new ttyd session. It's called once per session, so the returned
+// command must be a fresh one that hasn't been started yet. The request is nil if the session is started
+// by HandleTTYD.
+// Returned error is reported to the client, a *StatusError can be used to control the status code.
+type CommandFunc func(r *http.Request) (*exec.Cmd, error)
+
+// StatusError is an error with an HTTP status code that can be returned by a CommandFunc.
+// The message is sent to the client as the response body or as the reason of the WebSocket close frame.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.Code)
+	}
+	return e.Message
+}
+
+func errorStatus(err error) (int, string) {
+	var se *StatusError
+	if errors.As(err, &se) && se.Code >= 400 && se.Code <= 599 {
+		return se.Code, se.Error()
+	}
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
 }
 
 // Handler handles each ttyd session.
 type Handler struct {
-	cmd              *exec.Cmd
+	cmdFunc          CommandFunc
 	extension        *wsflate.Extension
 	writable         bool
 	options          map[string]any
 	messageSizeLimit int64
+	stallTimeout     time.Duration
 	compressionLevel int
 	title            string
 	pingInterval     time.Duration
+
+	resizePolicy    ResizePolicy
+	readOnlyViewers bool
+	detachTimeout   time.Duration
+	scrollback      int
+	recordingSink   RecordingSink
+	recordInput     bool
+	recordingFunc   RecordingFunc
+	urlArgs         bool
+	argValidator    ArgValidator
+	onStart         func(SessionInfo)
+	onEnd           func(SessionInfo)
+	sessionLock     sync.Mutex
+	sessions        map[string]*session
+	running         map[*session]struct{}
+	daemons         map[*daemon]struct{}
+	shutdown        bool
+
+	maxClients        int
+	maxClientsPerIP   int
+	maxClientsPerUser int
+	limiter           limiter
+	onIdle            func()
+
+	tokens         *TokenAuth
+	authHeader     string
+	trustedProxies []netip.Prefix
+	originCheck    bool
+	allowedOrigins []string
+	writableFunc   func(r *http.Request) bool
+	rateLimiter    RateLimiter
+	auditSink      AuditSink
+	auditInput     bool
+	inputTimeout   time.Duration
+	outputTimeout  time.Duration
+	maxDuration    time.Duration
+	pongTimeout    time.Duration
+	timeoutWarning time.Duration
+	streams        eventStreams
+	multiplexing   bool
+	maxChannels    int
+	muxes          map[*mux]struct{}
+	joinFunc       func(r *http.Request, info SessionInfo) bool
 }
 
 // NewHandler returns a new Handler with specified options applied.
-// cmd mustn't be nil.
+// cmd mustn't be nil. As a command can only be started once, the returned Handler can only serve one session,
+// use NewCommandHandler if the Handler is to serve multiple sessions.
 // By default, client input is not forwarded to the tty, no compression is negotiated, message has the size limit of 4096,
 // and no ping is sent by the server.
 func NewHandler(cmd *exec.Cmd, options ...HandlerOption) *Handler {
-	h := &Handler{
-		cmd:              cmd,
-		messageSizeLimit: 4096,
-	}
+	return NewCommandHandler(func(*http.Request) (*exec.Cmd, error) {
+		return cmd, nil
+	}, options...)
+}
+
+// NewCommandHandler returns a new Handler that calls fn to create the command for each session.
+// The returned Handler can be registered once and serve any number of concurrent sessions.
+// fn mustn't be nil. The defaults are the same as NewHandler.
+func NewCommandHandler(fn CommandFunc, options ...HandlerOption) *Handler {
+	return newHandler(&Handler{cmdFunc: fn}, options)
+}
+
+// newHandler sets the defaults of h, and then applies the options.
+func newHandler(h *Handler, options []HandlerOption) *Handler {
+	h.messageSizeLimit = 4096
+	h.timeoutWarning = DefaultTimeoutWarning
+	h.stallTimeout = stallTimeout
 	for _, option := range options {
 		option(h)
 	}
 	return h
 }
 
-// ServeHTTP upgrades the HTTP connection to a WebSocket connection and serve ttyd protocol on it.
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var (
-		conn net.Conn
-		brw  *bufio.ReadWriter
-		hs   ws.Handshake
-		err  error
-	)
+func (h *Handler) command(r *http.Request) (*exec.Cmd, error) {
+	var args []string
+	if h.urlArgs && r != nil {
+		args = r.URL.Query()["arg"]
+		if h.argValidator != nil {
+			err := h.argValidator(args)
+			if err != nil {
+				var se *StatusError
+				if !errors.As(err, &se) {
+					err = &StatusError{Code: http.StatusBadRequest, Message: err.Error()}
+				}
+				return nil, err
+			}
+		}
+	}
+
+	cmd, err := h.cmdFunc(r)
+	if err == nil && cmd == nil {
+		err = errors.New("ttyd: nil command")
+	}
+	if err == nil {
+		cmd.Args = append(cmd.Args, args...)
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = withoutXConnect(cmd.Env)
+		if user := RequestUser(r); user != "" {
+			cmd.Env = append(cmd.Env, UserEnv+"="+user)
+		}
+	}
+	return cmd, err
+}
+
+// withoutXConnect returns the environment with http2xconnect=1 removed from GODEBUG. Package xconnect sets it
+// for the HTTP/2 servers of this process, it mustn't change the programs run in the terminals.
+func withoutXConnect(env []string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "GODEBUG="); ok {
+			settings := slices.DeleteFunc(strings.Split(value, ","), func(setting string) bool {
+				return setting == "http2xconnect=1"
+			})
+			if len(settings) == 0 {
+				continue
+			}
+			kv = "GODEBUG=" + strings.Join(settings, ",")
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
+
+// upgrade upgrades the request to a WebSocket connection with additional response header.
+// Both HTTP/1.1 upgrade and HTTP/2 extended CONNECT are supported, as well as event streams.
+func (h *Handler) upgrade(w http.ResponseWriter, r *http.Request, header http.Header) (conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake, err error) {
+	if !h.checkOrigin(r) {
+		http.Error(w, errForbiddenOrigin.Message, errForbiddenOrigin.Code)
+		return nil, nil, hs, errForbiddenOrigin
+	}
+
+	if isEventStream(r) {
+		return h.upgradeEventStream(w, r, header)
+	}
+
 	if r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") != "" {
 		if h.extension != nil {
 			if extension := r.Header.Get("Sec-WebSocket-Extensions"); extension != "" {
@@ -81,7 +230,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 						var negotiated httphead.Option
 						negotiated, err = h.extension.Negotiate(opt)
 						if err != nil {
-							return
+							return nil, nil, hs, err
 						}
 						hs.Extensions = append(hs.Extensions, negotiated)
 					}
@@ -89,9 +238,17 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
-			hs.Protocol = protocol
-			w.Header().Set("Sec-WebSocket-Protocol", protocol)
+		accept := h.protocolFunc(r)
+		for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+			if protocol = strings.TrimSpace(protocol); accept(protocol) {
+				hs.Protocol = protocol
+				w.Header().Set("Sec-WebSocket-Protocol", protocol)
+				break
+			}
+		}
+
+		for k, v := range header {
+			w.Header()[k] = v
 		}
 
 		if len(hs.Extensions) > 0 {
@@ -103,7 +260,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		err = http.NewResponseController(w).Flush()
 		if err != nil {
-			return
+			return nil, nil, hs, err
 		}
 
 		localAddr := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
@@ -119,7 +276,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		brw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	} else {
 		upgrader := &ws.HTTPUpgrader{
-			Protocol: wsProtocol,
+			Protocol: h.protocolFunc(r),
+			Header:   header,
 		}
 		if h.extension != nil {
 			upgrader.Negotiate = h.extension.Negotiate
@@ -129,29 +287,164 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if conn != nil {
 				_ = conn.Close()
 			}
+			return nil, nil, hs, err
+		}
+	}
+
+	return conn, brw, hs, nil
+}
+
+// ServeHTTP upgrades the HTTP connection to a WebSocket connection and serve ttyd protocol on it.
+// Errors returned by the CommandFunc are reported as HTTP errors before the connection is upgraded.
+// The client is disconnected when the request context is done.
+//
+// For the networks blocking WebSockets, GET requests accepting text/event-stream are served the same protocol
+// over Server-Sent Events instead. The first event is a stream event with the stream ID as the data,
+// then each message is a message event with the message in base64, and a close event with the close code and reason
+// in JSON ends the stream. Messages of the client are POSTed to the same URL with EventStreamParam set to
+// the stream ID, one message per request body.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.isShutdown() {
+		http.Error(w, errShutdown.Message, errShutdown.Code)
+		return
+	}
+
+	if h.authHeader != "" {
+		var err error
+		r, err = headerUser(r, h.authHeader, h.trustedProxies)
+		if err != nil {
+			code, msg := errorStatus(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		h.serveEventInput(w, r)
+		return
+	}
+
+	// multiplexed connections are limited per channel instead
+	ip, user := RequestClientIP(r), RequestUser(r)
+	if !h.multiplexes(r) && !h.available(ip, user) {
+		http.Error(w, errTooManyClients.Message, errTooManyClients.Code)
+		return
+	}
+
+	if h.recordingFunc != nil {
+		h.serveReplay(w, r)
+		return
+	}
+
+	if h.multiplexes(r) {
+		conn, brw, hs, err := h.upgrade(w, r, nil)
+		if err != nil {
 			return
 		}
+		h.serveMux(r.Context(), r, conn, brw, hs)
+		_ = conn.Close()
+		return
+	}
+
+	var (
+		id  string
+		cmd *exec.Cmd
+		err error
+	)
+	if h.sessions != nil {
+		id = r.URL.Query().Get("session")
+		if id == "" {
+			id = newSessionID()
+		}
+	}
+	if id == "" || !h.hasSession(id) {
+		if ok, retryAfter := h.allowSession(ip, user); !ok {
+			TooManyRequests(w, retryAfter)
+			return
+		}
+
+		cmd, err = h.command(r)
+		if err != nil {
+			code, msg := errorStatus(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	var header http.Header
+	if id != "" {
+		header = http.Header{SessionHeader: []string{id}}
+	}
+	conn, brw, hs, err := h.upgrade(w, r, header)
+	if err != nil {
+		return
 	}
 
-	h.HandleTTYD(conn, brw, hs)
+	h.serve(r.Context(), r, id, cmd, conn, brw, hs)
 }
 
 // HandleTTYD handles a WebSocket connection upgraded through other means. Normally NewHandler should be used instead.
 // Provided bufio.ReadReadWriter should have buffers with the size of at least 512.
 // The writer buffer size will also impact how much data is read from the process per read operation.
+// Errors returned by the CommandFunc are reported with a WebSocket close frame.
+// If session sharing is enabled, the connection gets a new session that other clients can join.
 func (h *Handler) HandleTTYD(conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) {
+	h.HandleTTYDContext(context.Background(), conn, brw, hs)
+}
+
+// HandleTTYDContext is like HandleTTYD, but the client is disconnected when ctx is done.
+func (h *Handler) HandleTTYDContext(ctx context.Context, conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) {
+	ip := addrIP(conn.RemoteAddr().String())
+	if h.recordingFunc != nil {
+		h.handleReplay(ctx, conn, brw, hs)
+		return
+	}
+
+	if h.multiplexing && hs.Protocol == MuxProtocol {
+		h.serveMux(ctx, nil, conn, brw, hs)
+		return
+	}
+
+	if ok, _ := h.allowSession(ip, ""); !ok {
+		closeError(conn, brw, &StatusError{Code: http.StatusTooManyRequests})
+		return
+	}
+
+	var id string
+	if h.sessions != nil {
+		id = newSessionID()
+	}
+	h.serve(ctx, nil, id, nil, conn, brw, hs)
+}
+
+// newDaemon returns a daemon serving the connection with the negotiated extensions applied.
+func (h *Handler) newDaemon(conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) *daemon {
 	d := &daemon{
-		conn: &wsConn{
-			brw:  brw,
-			conn: conn,
-		},
-		cmd:              h.cmd,
-		resume:           make(chan struct{}),
-		writable:         h.writable,
+		conn:             h.newConn(conn, brw, hs),
+		resume:           make(chan struct{}, 1),
 		options:          h.options,
 		messageSizeLimit: h.messageSizeLimit,
 		title:            h.title,
+		tokens:           h.tokens,
+		since:            time.Now(),
+		ready:            make(chan struct{}, 1),
+		space:            make(chan struct{}, 1),
+		closing:          make(chan struct{}),
+		written:          make(chan struct{}),
 	}
+	d.lastInput.Store(d.since.UnixNano())
+	d.writable.Store(h.writable)
+	go d.writeLoop()
+	return d
+}
+
+// newConn returns a wsConn of the connection with the negotiated extensions applied.
+func (h *Handler) newConn(conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) *wsConn {
+	c := &wsConn{
+		brw:  brw,
+		conn: conn,
+	}
+	c.lr.R = c.brw
 
 	if len(hs.Extensions) > 0 {
 		var (
@@ -166,8 +459,8 @@ func (h *Handler) HandleTTYD(conn net.Conn, brw *bufio.ReadWriter, hs ws.Handsha
 			}
 		}
 
-		d.conn.e = e
-		d.conn.accepted = accepted
+		c.e = e
+		c.accepted = accepted
 
 		if accepted {
 			level := h.compressionLevel
@@ -175,20 +468,71 @@ func (h *Handler) HandleTTYD(conn net.Conn, brw *bufio.ReadWriter, hs ws.Handsha
 				level = flate.DefaultCompression
 			}
 
-			d.conn.fr = flate.NewReader(&d.conn.lr).(flateReader)
-			d.conn.fw, _ = flate.NewWriter(&d.conn.wb, level)
+			c.fr = flate.NewReader(&c.lr).(flateReader)
+			c.fw, _ = flate.NewWriter(&c.wb, level)
 		}
 	}
+	return c
+}
+
+func (h *Handler) serve(ctx context.Context, r *http.Request, id string, cmd *exec.Cmd, conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) {
+	addr, user := remoteAddr(r, conn), RequestUser(r)
+	ip := addrIP(addr)
+	if !h.acquire(ip, user) {
+		closeError(conn, brw, errTooManyClients)
+		return
+	}
+	served := false
+	defer func() {
+		h.release(ip, user, served)
+	}()
+
+	d := h.newDaemon(conn, brw, hs)
+	d.remoteAddr = addr
+	d.user = user
+	if h.writableFunc != nil && r != nil {
+		d.writable.Store(h.writableFunc(r))
+	}
+
+	err := h.attach(r, id, cmd, d)
+	if err != nil {
+		code, msg := errorStatus(err)
+		d.close(ReasonServerError, closeStatus(code), msg)
+		<-d.written
+		return
+	}
+	served = true
+
+	d.audit(AuditConnect, nil)
+	h.run(ctx, d, d.readLoop)
+}
+
+// run runs readLoop with the pings sent and the timeouts enforced in the background, and cleans up the daemon after it returns.
+// The daemon is closed early if ctx is done or the handler is shut down.
+func (h *Handler) run(ctx context.Context, d *daemon, readLoop func() error) {
+	if !h.track(d) {
+		close(d.resume)
+		d.close(ReasonShutdown, ws.StatusGoingAway, errShutdown.Message)
+		<-d.written
+		return
+	}
+	defer h.untrack(d)
+	stop := context.AfterFunc(ctx, func() {
+		d.close(ReasonCanceled, ws.StatusGoingAway, context.Cause(ctx).Error())
+	})
+	defer stop()
 
 	var done chan struct{}
-	if h.pingInterval > 0 {
+	if h.watches(d) {
 		done = make(chan struct{})
-		go d.pingLoop(time.NewTicker(h.pingInterval), done)
+		go h.watchLoop(d, done)
 	}
-	d.readLoop()
+	err := readLoop()
 	close(d.resume)
-	d.cleanup()
-	if h.pingInterval > 0 {
+	d.closeError(err)
+	if done != nil {
 		close(done)
 	}
+	// the connection is closed once written, event streams are no longer sent by another goroutine afterward
+	<-d.written
 }
@@ -0,0 +1,115 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// shell returns a CommandFunc running the script with sh.
+func shell(script string) CommandFunc {
+	return func(*http.Request) (*exec.Cmd, error) {
+		return exec.Command("sh", "-c", script), nil
+	}
+}
+
+// withTestUser authenticates the requests as the user in the X-Test-User header.
+func withTestUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Header.Get("X-Test-User"); user != "" {
+			r = RequestWithUser(r, user)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startServer serves the handler until the test ends, and returns the URL of the server.
+func startServer(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func dial(t *testing.T, url string, options ...client.Option) *client.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.Dial(ctx, url, append([]client.Option{client.WithToken("")}, options...)...)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	// reads fail instead of hanging if the server never closes the connection
+	timer := time.AfterFunc(10*time.Second, func() {
+		_ = conn.Close()
+	})
+	t.Cleanup(func() {
+		timer.Stop()
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// readAll reads the output until the connection is closed, and returns it with the close error if it's not normal.
+func readAll(t *testing.T, conn *client.Conn) (string, *client.CloseError) {
+	t.Helper()
+	var sb strings.Builder
+	_, err := io.Copy(&sb, conn)
+	var ce *client.CloseError
+	if err != nil && !errors.As(err, &ce) {
+		t.Fatal("read:", err)
+	}
+	return sb.String(), conn.CloseError()
+}
+
+// dialRaw connects a WebSocket client that sends nothing.
+func dialRaw(t *testing.T, url string) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := ws.Dialer{
+		Protocols: []string{ttyProtocol},
+	}
+	conn, _, _, err := dialer.Dial(ctx, strings.Replace(url, "http", "ws", 1))
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// dialStalled connects a client that reports its size and never reads again.
+func dialStalled(t *testing.T, url string) {
+	t.Helper()
+	err := wsutil.WriteClientBinary(dialRaw(t, url), []byte(`{"AuthToken":"","columns":80,"rows":24}`))
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+}
+
+// waitFor polls until cond is true, and fails the test if it isn't within 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
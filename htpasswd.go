@@ -0,0 +1,339 @@
+package ttyd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCheckInterval is the minimum interval between checks whether the htpasswd file is changed.
+const htpasswdCheckInterval = time.Second
+
+// dummyHash is compared against when the user doesn't exist, so that the response time doesn't reveal valid users.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("ttyd"), bcrypt.DefaultCost)
+
+// Htpasswd authenticates users with an htpasswd file. Passwords hashed with bcrypt ($2y$), MD5 ($apr1$ and $1$),
+// SHA-1 ({SHA}), SHA-256 ($5$) and SHA-512 ($6$) are supported, and files with other entries are rejected.
+// The file is reloaded when it's changed, or Reload is called.
+type Htpasswd struct {
+	name string
+
+	lock    sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// LoadHtpasswd loads the users from the htpasswd file.
+func LoadHtpasswd(name string) (*Htpasswd, error) {
+	h := &Htpasswd{name: name}
+	err := h.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reloads the users from the file. The current users are kept if the file can't be read or has
+// malformed entries or unsupported hashes.
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("ttyd: %s:%d: malformed entry", h.name, n)
+		}
+		if !supportedHash(hash) {
+			return fmt.Errorf("ttyd: %s:%d: unsupported password hash of user %q", h.name, n, user)
+		}
+		users[user] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	h.users = users
+	h.modTime = fi.ModTime()
+	h.size = fi.Size()
+	h.checked = time.Now()
+	h.lock.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the file if its modification time or size is changed since the last load.
+func (h *Htpasswd) reloadIfChanged() {
+	h.lock.Lock()
+	if time.Since(h.checked) < htpasswdCheckInterval {
+		h.lock.Unlock()
+		return
+	}
+	h.checked = time.Now()
+	modTime, size := h.modTime, h.size
+	h.lock.Unlock()
+
+	fi, err := os.Stat(h.name)
+	if err == nil && (!fi.ModTime().Equal(modTime) || fi.Size() != size) {
+		_ = h.Reload()
+	}
+}
+
+// Authenticate reports whether the password matches the one of the user.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	h.reloadIfChanged()
+	h.lock.RLock()
+	hash, ok := h.users[user]
+	h.lock.RUnlock()
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return matchPassword(hash, password)
+}
+
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$apr1$", "$1$", "{SHA}", "$5$", "$6$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(md5Crypt(hash, password))) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$5$"):
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(shaCrypt(sha256.New, sha256Order, hash, password))) == 1
+	case strings.HasPrefix(hash, "$6$"):
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(shaCrypt(sha512.New, sha512Order, hash, password))) == 1
+	}
+	return false
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// byte order of the MD5-crypt and SHA-crypt encodings, in groups of 3 bytes.
+var (
+	md5Order    = []int{0, 6, 12, 1, 7, 13, 2, 8, 14, 3, 9, 15, 4, 10, 5, 11}
+	sha256Order = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14, 15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		31, 30,
+	}
+	sha512Order = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4, 47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35, 15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60,
+		40, 61, 19, 62, 20, 41, 63,
+	}
+)
+
+// shaCrypt computes the SHA-crypt hash of the password with the prefix, rounds and salt of the setting,
+// in the format of $5$rounds=N$salt$hash. It returns an empty string if the setting is malformed.
+func shaCrypt(newHash func() hash.Hash, order []int, setting, password string) string {
+	prefix := setting[:3]
+	rest := setting[3:]
+	rounds, customRounds := 5000, false
+	if strings.HasPrefix(rest, "rounds=") {
+		value, after, ok := strings.Cut(rest[len("rounds="):], "$")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			return ""
+		}
+		rounds, customRounds, rest = min(max(n, 1000), 999999999), true, after
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	p, s := []byte(password), []byte(salt)
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	for n := len(p); n > 0; n -= len(b) {
+		h.Write(b[:min(n, len(b))])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	dp := h.Sum(nil)
+	pp := bytes.Repeat(dp, len(p)/len(dp)+1)[:len(p)]
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	ds := h.Sum(nil)
+	ss := ds[:len(s)]
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pp)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(ss)
+		}
+		if i%7 != 0 {
+			h.Write(pp)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pp)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	if customRounds {
+		sb.WriteString("rounds=")
+		sb.WriteString(strconv.Itoa(rounds))
+		sb.WriteByte('$')
+	}
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	cryptEncode(&sb, c, order)
+	return sb.String()
+}
+
+// md5Crypt computes the MD5-crypt hash of the password with the prefix and salt of the setting, in the format
+// of $apr1$salt$hash as Apache does, or $1$salt$hash.
+func md5Crypt(setting, password string) string {
+	prefix := "$1$"
+	if strings.HasPrefix(setting, "$apr1$") {
+		prefix = "$apr1$"
+	}
+	salt, _, _ := strings.Cut(setting[len(prefix):], "$")
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	p, s := []byte(password), []byte(salt)
+	h := md5.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write([]byte(prefix))
+	h.Write(s)
+	for n := len(p); n > 0; n -= len(b) {
+		h.Write(b[:min(n, len(b))])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(p[:1])
+		}
+	}
+	c := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	cryptEncode(&sb, c, md5Order)
+	return sb.String()
+}
+
+// cryptEncode writes the bytes of the hash in the order with the crypt alphabet, 4 characters for each 3 bytes.
+func cryptEncode(sb *strings.Builder, c []byte, order []int) {
+	for i := 0; i < len(order); i += 3 {
+		var w uint32
+		n := 4
+		switch len(order) - i {
+		case 1:
+			w, n = uint32(c[order[i]]), 2
+		case 2:
+			w, n = uint32(c[order[i]])<<8|uint32(c[order[i+1]]), 3
+		default:
+			w = uint32(c[order[i]])<<16 | uint32(c[order[i+1]])<<8 | uint32(c[order[i+2]])
+		}
+		for ; n > 0; n-- {
+			sb.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package ttyd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "htpasswd")
+	err = os.WriteFile(name, []byte(`# users
+bcrypt:`+string(bcryptHash)+`
+apr1:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+md5:$1$abc$BXBqpb9BZcZhXLgbee.0s/
+sha1:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+sha256:$5$salt$kpa26zwgX83BPSR8d7w93OIXbFt/d3UOTZaAu5vsTM6
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := LoadHtpasswd(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"bcrypt", "secret", true},
+		{"bcrypt", "wrong", false},
+		{"apr1", "secret", true},
+		{"apr1", "wrong", false},
+		{"md5", "password", true},
+		{"sha1", "secret", true},
+		{"sha256", "secret", true},
+		{"sha256", "wrong", false},
+		{"nobody", "secret", false},
+	} {
+		if ok := h.Authenticate(tt.user, tt.password); ok != tt.ok {
+			t.Errorf("Authenticate(%q, %q) = %v", tt.user, tt.password, ok)
+		}
+	}
+}
+
+func TestHtpasswdUnsupported(t *testing.T) {
+	for _, entry := range []string{"plain:secret", "des:rqXexS6ZhobKA", "malformed"} {
+		name := filepath.Join(t.TempDir(), "htpasswd")
+		err := os.WriteFile(name, []byte(entry+"\n"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadHtpasswd(name); err == nil {
+			t.Errorf("%q is loaded", entry)
+		}
+	}
+}
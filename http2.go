@@ -0,0 +1,102 @@
+//go:build go1.24
+
+package ttyd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var errExtendedConnectDisabled = errors.New("ttyd: extended CONNECT is disabled, import github.com/WeidiDeng/ttyd-go/xconnect or set GODEBUG=http2xconnect=1")
+
+// ConfigureHTTP2 configures the server to serve HTTP/2 besides HTTP/1.1, so that the WebSockets can use
+// the extended CONNECT protocol and share connections. If h2c is true, HTTP/2 without TLS is also served to
+// clients with prior knowledge, which browsers never do.
+// It returns an error if extended CONNECT isn't enabled for net/http, see package xconnect. net/http only reads
+// GODEBUG when it's initialized, so setting it later has no effect, and the servers of net/http are probed instead.
+func ConfigureHTTP2(srv *http.Server, h2c bool) error {
+	if !extendedConnect() {
+		return errExtendedConnectDisabled
+	}
+
+	if srv.Protocols == nil {
+		srv.Protocols = new(http.Protocols)
+	}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(h2c)
+	return nil
+}
+
+// extendedConnect reports whether the HTTP/2 servers of net/http advertise SETTINGS_ENABLE_CONNECT_PROTOCOL,
+// by reading the settings of a server over a pipe.
+var extendedConnect = sync.OnceValue(func() bool {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Handler:   http.NotFoundHandler(),
+		Protocols: protocols,
+	}
+	defer srv.Close()
+	go func() {
+		_ = srv.Serve(&pipeListener{conn: peer, done: make(chan struct{})})
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		_, err := conn.Write([]byte(http2.ClientPreface))
+		if err == nil {
+			_ = http2.NewFramer(conn, nil).WriteSettings()
+		}
+	}()
+	fr := http2.NewFramer(nil, conn)
+	f, err := fr.ReadFrame()
+	if err != nil {
+		return false
+	}
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		return false
+	}
+	v, ok := sf.Value(http2.SettingEnableConnectProtocol)
+	return ok && v == 1
+})
+
+// pipeListener accepts the connection once, and then blocks until closed.
+type pipeListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -50,10 +50,6 @@ func (h *http2Conn) RemoteAddr() net.Addr {
 }
 
 func (h *http2Conn) SetDeadline(t time.Time) error {
-	return http.NewResponseController(h.w).SetReadDeadline(t)
-}
-
-func (h *http2Conn) SetReadDeadline(t time.Time) error {
 	err := h.SetReadDeadline(t)
 	if err != nil {
 		return err
@@ -61,6 +57,10 @@ func (h *http2Conn) SetReadDeadline(t time.Time) error {
 	return h.SetWriteDeadline(t)
 }
 
+func (h *http2Conn) SetReadDeadline(t time.Time) error {
+	return http.NewResponseController(h.w).SetReadDeadline(t)
+}
+
 func (h *http2Conn) SetWriteDeadline(t time.Time) error {
 	return http.NewResponseController(h.w).SetWriteDeadline(t)
 }
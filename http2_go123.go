@@ -0,0 +1,14 @@
+//go:build !go1.24
+
+package ttyd
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ConfigureHTTP2 configures the server to serve HTTP/2 besides HTTP/1.1, so that the WebSockets can use
+// the extended CONNECT protocol and share connections. It requires Go 1.24 or later.
+func ConfigureHTTP2(*http.Server, bool) error {
+	return errors.New("ttyd: extended CONNECT requires go1.24 or later")
+}
@@ -0,0 +1,83 @@
+//go:build go1.24 && !windows
+
+package ttyd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+	_ "github.com/WeidiDeng/ttyd-go/xconnect"
+)
+
+// startHTTP2Server serves the handler over HTTP/1.1 and HTTP/2 without TLS until the test ends, and returns
+// the URL of the server.
+func startHTTP2Server(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	err := ConfigureHTTP2(srv.Config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestConfigureHTTP2(t *testing.T) {
+	h := NewCommandHandler(shell("echo hello"), EnableCompressionWithContextTakeover())
+	protos := make(chan int, 1)
+	url := startHTTP2Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+		h.ServeHTTP(w, r)
+	}))
+
+	for _, tt := range []struct {
+		name    string
+		options []client.Option
+		proto   int
+	}{
+		{"HTTP/1.1", nil, 1},
+		{"HTTP/1.1 compressed", []client.Option{client.WithCompression()}, 1},
+		{"HTTP/2", []client.Option{client.WithHTTP2()}, 2},
+		{"HTTP/2 compressed", []client.Option{client.WithHTTP2(), client.WithCompression()}, 2},
+	} {
+		out, ce := readAll(t, dial(t, url, tt.options...))
+		if !strings.Contains(out, "hello") {
+			t.Fatalf("%s: output = %q, closed with %v", tt.name, out, ce)
+		}
+		if proto := <-protos; proto != tt.proto {
+			t.Fatalf("%s: served over HTTP/%d", tt.name, proto)
+		}
+	}
+}
+
+func TestHTTP2IdleTimeout(t *testing.T) {
+	// the idle timeout interrupts the read through the deadline of the extended CONNECT stream
+	h := NewCommandHandler(shell("exec sleep 5"), WithIdleTimeout(200*time.Millisecond, 0))
+	_, ce := readAll(t, dial(t, startHTTP2Server(t, h), client.WithHTTP2()))
+	if ce == nil || ce.Reason != ReasonIdleTimeout.String() {
+		t.Fatalf("closed with %v", ce)
+	}
+}
+
+func TestCommandWithoutXConnect(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.Fatal("xconnect didn't set GODEBUG")
+	}
+	h := NewCommandHandler(shell(`echo "GODEBUG=$GODEBUG"`))
+	out, _ := readAll(t, dial(t, startServer(t, h)))
+	if !strings.Contains(out, "GODEBUG=\r\n") {
+		t.Fatalf("GODEBUG of the command = %q", out)
+	}
+
+	env := withoutXConnect([]string{"GODEBUG=http2debug=1,http2xconnect=1", "HOME=/"})
+	if !slices.Equal(env, []string{"GODEBUG=http2debug=1", "HOME=/"}) {
+		t.Fatalf("environment = %q", env)
+	}
+}
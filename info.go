@@ -0,0 +1,127 @@
+package ttyd
+
+import (
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// TerminationReason describes why a session ended.
+type TerminationReason int
+
+const (
+	// ReasonProcessExit means the process exited or closed its tty.
+	ReasonProcessExit TerminationReason = iota
+	// ReasonClientClose means the last client closed the connection or the connection was lost.
+	ReasonClientClose
+	// ReasonPingFailure means the last client failed to receive a ping.
+	ReasonPingFailure
+	// ReasonFrameTooLarge means the last client sent a message larger than the message size limit.
+	ReasonFrameTooLarge
+	// ReasonProtocolError means the last client violated the WebSocket or ttyd protocol.
+	ReasonProtocolError
+	// ReasonDetachTimeout means no client reattached to the session during the detach grace period.
+	ReasonDetachTimeout
+	// ReasonShutdown means the handler is shut down.
+	ReasonShutdown
+	// ReasonCanceled means the context of the last client is done.
+	ReasonCanceled
+	// ReasonServerError means the server failed to serve the last client, for example failed to start the process.
+	ReasonServerError
+	// ReasonUnauthorized means the last client failed token authentication.
+	ReasonUnauthorized
+	// ReasonIdleTimeout means the last client sent no input or received no output for the idle timeout.
+	ReasonIdleTimeout
+	// ReasonTimeLimit means the session ran for the maximum duration.
+	ReasonTimeLimit
+	// ReasonPongTimeout means the last client didn't answer a ping in time.
+	ReasonPongTimeout
+	// ReasonStalled means the last client stopped reading the output of the session it shared with other clients.
+	ReasonStalled
+)
+
+var reasonNames = [...]string{
+	ReasonProcessExit:   "process exit",
+	ReasonClientClose:   "client close",
+	ReasonPingFailure:   "ping failure",
+	ReasonFrameTooLarge: "frame too large",
+	ReasonProtocolError: "protocol error",
+	ReasonDetachTimeout: "detach timeout",
+	ReasonShutdown:      "shutdown",
+	ReasonCanceled:      "canceled",
+	ReasonServerError:   "server error",
+	ReasonUnauthorized:  "unauthorized",
+	ReasonIdleTimeout:   "idle timeout",
+	ReasonTimeLimit:     "time limit",
+	ReasonPongTimeout:   "pong timeout",
+	ReasonStalled:       "stalled",
+}
+
+func (r TerminationReason) String() string {
+	if r >= 0 && int(r) < len(reasonNames) {
+		return reasonNames[r]
+	}
+	return "unknown"
+}
+
+// SessionInfo describes a session for the lifecycle hooks.
+type SessionInfo struct {
+	// ID is the session ID.
+	ID string
+	// Request is the request of the client that started the session. It's nil if the session is started by HandleTTYD.
+	// It mustn't be modified.
+	Request *http.Request
+	// RemoteAddr is the remote address of the client that started the session, or its IP if it's found by FilterIP.
+	RemoteAddr string
+	// User is the authenticated user of the client that started the session, as reported by RequestUser.
+	User string
+	// Pid is the process ID of the command. It's zero if the process isn't started yet, which WithJoinFunc may see
+	// for a session whose first client hasn't reported its size.
+	Pid int
+	// StartTime is the time when the process started.
+	StartTime time.Time
+	// EndTime is the time when the process is waited. It's zero in OnSessionStart.
+	EndTime time.Time
+	// ExitCode is the exit code of the process, or -1 if the process is killed by a signal. It's only valid in OnSessionEnd.
+	ExitCode int
+	// Signal is the signal that killed the process, if any.
+	Signal os.Signal
+	// BytesIn is the number of bytes of client input forwarded to the tty.
+	BytesIn int64
+	// BytesOut is the number of bytes read from the tty.
+	BytesOut int64
+	// Reason is why the session ended. It's only valid in OnSessionEnd.
+	Reason TerminationReason
+	// ProcessState is the state of the process after it's waited. It's nil in OnSessionStart.
+	ProcessState *os.ProcessState
+}
+
+// info returns the information of the session. The lock must be held.
+func (s *session) info() SessionInfo {
+	info := SessionInfo{
+		ID:         s.id,
+		Request:    s.request,
+		RemoteAddr: s.remoteAddr,
+		User:       s.user,
+		StartTime:  s.startTime,
+		EndTime:    s.endTime,
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+		Reason:     s.reason,
+	}
+	if s.cmd.Process != nil {
+		info.Pid = s.cmd.Process.Pid
+	}
+	if !s.endTime.IsZero() && s.cmd.ProcessState != nil {
+		info.ProcessState = s.cmd.ProcessState
+		info.ExitCode = info.ProcessState.ExitCode()
+		if status, ok := info.ProcessState.Sys().(interface {
+			Signaled() bool
+			Signal() syscall.Signal
+		}); ok && status.Signaled() {
+			info.Signal = status.Signal()
+		}
+	}
+	return info
+}
@@ -0,0 +1,80 @@
+package ttyd
+
+import (
+	"net/http"
+	"sync"
+)
+
+var errTooManyClients = &StatusError{Code: http.StatusServiceUnavailable, Message: "too many clients"}
+
+// limiter counts the connected clients in total, per IP and per user.
+type limiter struct {
+	lock  sync.Mutex
+	total int
+	ips   map[string]int
+	users map[string]int
+	// served is whether a client has been attached to a session since the idle function was last called
+	served bool
+}
+
+// full reports whether any of the limits is reached for the client. The lock must be held.
+func (h *Handler) full(ip, user string) bool {
+	l := &h.limiter
+	return h.maxClients > 0 && l.total >= h.maxClients ||
+		h.maxClientsPerIP > 0 && l.ips[ip] >= h.maxClientsPerIP ||
+		h.maxClientsPerUser > 0 && user != "" && l.users[user] >= h.maxClientsPerUser
+}
+
+// available reports whether the client may connect, so that it can be rejected before the connection is upgraded.
+func (h *Handler) available(ip, user string) bool {
+	h.limiter.lock.Lock()
+	defer h.limiter.lock.Unlock()
+	return !h.full(ip, user)
+}
+
+// acquire reserves a slot for the client once its connection is upgraded. It fails if any of the limits is reached.
+func (h *Handler) acquire(ip, user string) bool {
+	l := &h.limiter
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if h.full(ip, user) {
+		return false
+	}
+
+	if l.ips == nil {
+		l.ips = make(map[string]int)
+		l.users = make(map[string]int)
+	}
+	l.total++
+	l.ips[ip]++
+	if user != "" {
+		l.users[user]++
+	}
+	return true
+}
+
+// release frees the slot of the client, and calls the idle function if it's the last client and a client has been
+// attached to a session meanwhile, so that failed requests don't make the handler idle.
+func (h *Handler) release(ip, user string, served bool) {
+	l := &h.limiter
+	l.lock.Lock()
+	l.served = l.served || served
+	l.total--
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+	if user != "" {
+		if l.users[user]--; l.users[user] <= 0 {
+			delete(l.users, user)
+		}
+	}
+	idle := l.total == 0 && l.served
+	if idle {
+		l.served = false
+	}
+	l.lock.Unlock()
+
+	if idle && h.onIdle != nil {
+		h.onIdle()
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestOnIdle(t *testing.T) {
+	idle := make(chan struct{}, 1)
+	h := NewCommandHandler(shell("echo hello"), CheckOrigin(), OnIdle(func() {
+		idle <- struct{}{}
+	}))
+	url := startServer(t, h)
+
+	// neither a plain request nor a cross-origin one is a client
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain request status = %d", resp.StatusCode)
+	}
+	_, err = client.Dial(context.Background(), url, client.WithToken(""), client.WithHeader("Origin", "https://example.com"))
+	if err == nil {
+		t.Fatal("cross-origin request is served")
+	}
+	select {
+	case <-idle:
+		t.Fatal("idle after failed requests")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	out, _ := readAll(t, dial(t, url))
+	if !strings.Contains(out, "hello") {
+		t.Fatalf("output = %q", out)
+	}
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not idle after the session ended")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	h := NewCommandHandler(shell("sleep 5"), WithMaxClients(1))
+	url := startServer(t, h)
+
+	dial(t, url)
+	waitFor(t, "the client to connect", func() bool {
+		h.limiter.lock.Lock()
+		defer h.limiter.lock.Unlock()
+		return h.limiter.total == 1
+	})
+	_, err := client.Dial(context.Background(), url, client.WithToken(""))
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("dial over the limit = %v", err)
+	}
+}
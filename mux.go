@@ -0,0 +1,530 @@
+package ttyd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// MuxProtocol is the WebSocket subprotocol multiplexing the ttyd protocol of many terminals over one connection,
+// see EnableMultiplexing.
+const MuxProtocol = "tty-mux"
+
+// MuxWindow is how many bytes of data messages may be sent on a channel in each direction before the receiver
+// acknowledges them with window messages.
+const MuxWindow = 1 << 16
+
+const (
+	muxOpen   = 'o'
+	muxData   = 'd'
+	muxWindow = 'w'
+	muxClose  = 'c'
+
+	// muxHeaderSize is the size of the message type and the channel ID that start every message
+	muxHeaderSize = 5
+)
+
+var (
+	errChannelInUse    = errors.New("channel in use")
+	errWindowExceeded  = errors.New("window exceeded")
+	errTooManyChannels = &StatusError{Code: http.StatusServiceUnavailable, Message: "too many channels"}
+)
+
+// mux serves the channels multiplexed over a WebSocket connection.
+type mux struct {
+	h    *Handler
+	ctx  context.Context
+	r    *http.Request
+	conn *wsConn
+	wg   sync.WaitGroup
+
+	lock     sync.Mutex
+	channels map[uint32]*muxChannel
+	closing  bool
+	code     ws.StatusCode
+	reason   string
+	closed   atomic.Bool
+}
+
+// muxChannel is a channel of a mux. Like an event stream, it's one end of a pipe, the other end is fed with
+// the messages of the client as masked WebSocket frames, and the WebSocket frames written by the daemon are read
+// from it and sent as messages of the channel, so the daemon serves it like a WebSocket connection.
+type muxChannel struct {
+	net.Conn
+	peer net.Conn
+	m    *mux
+	id   uint32
+
+	// window is how many bytes of data messages may still be sent to the client, it's signaled on more when increased
+	window atomic.Int64
+	more   chan struct{}
+	// pending is how many bytes of data messages of the client are not acknowledged yet
+	pending atomic.Int64
+
+	lock  sync.Mutex
+	queue [][]byte
+	ready chan struct{}
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+	done     chan struct{}
+}
+
+// multiplexes reports whether the request offers MuxProtocol and it's enabled.
+func (h *Handler) multiplexes(r *http.Request) bool {
+	if !h.multiplexing || h.recordingFunc != nil || isEventStream(r) {
+		return false
+	}
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if strings.TrimSpace(protocol) == MuxProtocol {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolFunc returns the function choosing the subprotocol of the request. MuxProtocol is chosen whenever
+// it's offered and enabled, regardless of the order of the offers.
+func (h *Handler) protocolFunc(r *http.Request) func(string) bool {
+	if h.multiplexes(r) {
+		return func(protocol string) bool {
+			return protocol == MuxProtocol
+		}
+	}
+	return wsProtocol
+}
+
+// serveMux serves the channels multiplexed over the connection until it's closed. The connection counts as
+// one client, and each channel starts or joins a session the same way as a connection of its own.
+// r is nil if the connection is handled by HandleTTYD.
+func (h *Handler) serveMux(ctx context.Context, r *http.Request, conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) {
+	m := &mux{
+		h:        h,
+		ctx:      ctx,
+		r:        r,
+		conn:     h.newConn(conn, brw, hs),
+		channels: make(map[uint32]*muxChannel),
+	}
+	if !h.trackMux(m) {
+		m.conn.CloseWithStatus(ws.StatusGoingAway, errShutdown.Message)
+		return
+	}
+	defer h.untrackMux(m)
+	stop := context.AfterFunc(ctx, func() {
+		m.shutdown(ws.StatusGoingAway, context.Cause(ctx).Error())
+	})
+	defer stop()
+
+	var done chan struct{}
+	if h.pingInterval > 0 {
+		done = make(chan struct{})
+		go m.pingLoop(done)
+	}
+	err := m.readLoop()
+	m.closeError(err)
+	if done != nil {
+		close(done)
+	}
+
+	m.lock.Lock()
+	for _, ch := range m.channels {
+		ch.stop()
+	}
+	m.lock.Unlock()
+	// the channels write to the connection until they are done
+	m.wg.Wait()
+}
+
+// readLoop handles client messages until an error occurs. Data messages of the closed channels are ignored,
+// as the client may send them before it receives the close message.
+func (m *mux) readLoop() error {
+	limit := m.h.messageSizeLimit
+	if limit > 0 {
+		limit += muxHeaderSize
+	}
+	for {
+		m.conn.rb.Reset()
+		err := m.conn.nextFrame()
+		if err != nil {
+			return err
+		}
+		err = m.conn.readFrame(limit)
+		if err != nil {
+			return err
+		}
+
+		msg := m.conn.rb.Bytes()
+		if len(msg) < muxHeaderSize {
+			return errInvalidMessage
+		}
+		id := binary.BigEndian.Uint32(msg[1:])
+		p := msg[muxHeaderSize:]
+		switch msg[0] {
+		case muxOpen:
+			err = m.open(id, string(p))
+		case muxData:
+			if ch := m.channel(id); ch != nil && len(p) > 0 {
+				err = ch.receive(p)
+			}
+		case muxWindow:
+			if len(p) != 4 {
+				return errInvalidMessage
+			}
+			if ch := m.channel(id); ch != nil {
+				ch.window.Add(int64(binary.BigEndian.Uint32(p)))
+				select {
+				case ch.more <- struct{}{}:
+				default:
+				}
+			}
+		case muxClose:
+			if ch := m.channel(id); ch != nil {
+				ch.stop()
+			}
+		default:
+			return errInvalidMessage
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeError closes the connection with the close code and text describing the error that ends readLoop.
+func (m *mux) closeError(err error) {
+	var pe ws.ProtocolError
+	switch {
+	case errors.Is(err, errFrameTooLarge):
+		m.close(ws.StatusMessageTooBig, err.Error())
+	case errors.As(err, &pe), errors.Is(err, errInvalidMessage), errors.Is(err, errChannelInUse), errors.Is(err, errWindowExceeded):
+		m.close(ws.StatusProtocolError, err.Error())
+	default:
+		m.close(ws.StatusNormalClosure, "")
+	}
+}
+
+// close closes the connection once, which ends readLoop.
+func (m *mux) close(code ws.StatusCode, reason string) {
+	if m.closed.CompareAndSwap(false, true) {
+		if code == ws.StatusNormalClosure && reason == "" {
+			m.conn.Close()
+		} else {
+			m.conn.CloseWithStatus(code, reason)
+		}
+	}
+}
+
+// shutdown closes the connection after the channels are closed, so that the clients receive the close messages
+// of the channels first. New channels are refused. The connection is closed anyway after closeTimeout.
+func (m *mux) shutdown(code ws.StatusCode, reason string) {
+	m.lock.Lock()
+	if !m.closing {
+		m.closing = true
+		m.code = code
+		m.reason = reason
+	}
+	drained := len(m.channels) == 0
+	m.lock.Unlock()
+
+	if drained {
+		m.close(code, reason)
+	} else {
+		time.AfterFunc(closeTimeout, func() {
+			m.close(code, reason)
+		})
+	}
+}
+
+// pingLoop sends the pings until done is closed. Pongs are awaited for the whole connection instead of each channel,
+// and the connection is closed if one isn't received within the pong timeout, which is checked at each ping.
+func (m *mux) pingLoop(done chan struct{}) {
+	h := m.h
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if pinged := m.conn.pinged.Load(); h.pongTimeout > 0 && pinged != 0 && now.Sub(time.Unix(0, pinged)) >= h.pongTimeout {
+				m.close(ws.StatusGoingAway, ReasonPongTimeout.String())
+				return
+			}
+		}
+
+		err := m.conn.Ping()
+		if err != nil {
+			m.close(ws.StatusGoingAway, "ping failure")
+			return
+		}
+	}
+}
+
+func (m *mux) channel(id uint32) *muxChannel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.channels[id]
+}
+
+// open opens the channel with the query of the channel. The client is answered with an open message carrying
+// the session ID if the channel is served, or a close message if not.
+func (m *mux) open(id uint32, query string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.channels[id]; ok {
+		return errChannelInUse
+	}
+
+	var err error
+	switch {
+	case m.closing:
+		err = &StatusError{Code: http.StatusServiceUnavailable, Message: m.reason}
+	case m.h.maxChannels > 0 && len(m.channels) >= m.h.maxChannels:
+		err = errTooManyChannels
+	}
+
+	conn, peer := net.Pipe()
+	ch := &muxChannel{
+		Conn:    conn,
+		peer:    peer,
+		m:       m,
+		id:      id,
+		more:    make(chan struct{}, 1),
+		ready:   make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	ch.window.Store(MuxWindow)
+	m.channels[id] = ch
+
+	m.wg.Add(3)
+	go ch.writeLoop()
+	go ch.inputLoop()
+	go m.serveChannel(ch, query, err)
+	return nil
+}
+
+// serveChannel serves the channel like ServeHTTP serves a connection, the query of the channel replaces
+// the query of the request.
+func (m *mux) serveChannel(ch *muxChannel, query string, err error) {
+	defer m.wg.Done()
+	defer func() {
+		_ = ch.Close()
+		<-ch.done
+	}()
+
+	h := m.h
+	brw := bufio.NewReadWriter(bufio.NewReader(ch), bufio.NewWriter(ch))
+	r := m.r
+	if r != nil {
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = query
+	}
+
+	var (
+		ip, user = addrIP(remoteAddr(r, ch)), RequestUser(r)
+		id       string
+		cmd      *exec.Cmd
+	)
+	if err == nil && !h.available(ip, user) {
+		err = errTooManyClients
+	}
+	if err == nil && h.sessions != nil {
+		if r != nil {
+			id = r.URL.Query().Get("session")
+		}
+		if id == "" {
+			id = newSessionID()
+		}
+	}
+	if err == nil && (id == "" || !h.hasSession(id)) {
+		if ok, _ := h.allowSession(ip, user); !ok {
+			err = &StatusError{Code: http.StatusTooManyRequests}
+		} else {
+			cmd, err = h.command(r)
+		}
+	}
+	if err != nil {
+		closeError(ch, brw, err)
+		return
+	}
+
+	// the open message is sent by writeLoop, so that it can't follow the close message of a channel closed meanwhile
+	err = ws.WriteFrame(ch, ws.NewTextFrame([]byte(id)))
+	if err != nil {
+		return
+	}
+	h.serve(m.ctx, r, id, cmd, ch, brw, ws.Handshake{Protocol: ttyProtocol})
+}
+
+// remove removes the channel, and closes the connection if it's shutting down and this is the last channel.
+func (m *mux) remove(ch *muxChannel) {
+	m.lock.Lock()
+	if m.channels[ch.id] == ch {
+		delete(m.channels, ch.id)
+	}
+	drained := m.closing && len(m.channels) == 0
+	code, reason := m.code, m.reason
+	m.lock.Unlock()
+
+	if drained {
+		m.close(code, reason)
+	}
+}
+
+// appendMuxHeader appends the message with the type and the channel ID to b.
+func appendMuxHeader(b []byte, op byte, id uint32, p []byte) []byte {
+	b = append(b, op)
+	b = binary.BigEndian.AppendUint32(b, id)
+	return append(b, p...)
+}
+
+// receive queues the data message of the client for inputLoop. The client mustn't send more than
+// the window allows.
+func (ch *muxChannel) receive(p []byte) error {
+	if ch.pending.Add(int64(len(p))) > MuxWindow {
+		return errWindowExceeded
+	}
+	ch.lock.Lock()
+	ch.queue = append(ch.queue, bytes.Clone(p))
+	ch.lock.Unlock()
+	select {
+	case ch.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// inputLoop writes the queued messages of the client to the daemon, so that a daemon that doesn't read, such as one
+// writing to a tty whose process doesn't read its input, can't block the other channels. The messages are
+// acknowledged every half window.
+func (ch *muxChannel) inputLoop() {
+	defer ch.m.wg.Done()
+	var consumed int64
+	for {
+		select {
+		case <-ch.ready:
+		case <-ch.done:
+			return
+		}
+
+		ch.lock.Lock()
+		queue := ch.queue
+		ch.queue = nil
+		ch.lock.Unlock()
+		for _, p := range queue {
+			err := writeClientFrame(ch.peer, ws.OpBinary, p)
+			if err != nil {
+				return
+			}
+			consumed += int64(len(p))
+		}
+
+		if consumed >= MuxWindow/2 {
+			ch.pending.Add(-consumed)
+			_, err := ch.m.conn.Write(appendMuxHeader(nil, muxWindow, ch.id, binary.BigEndian.AppendUint32(nil, uint32(consumed))))
+			if err != nil {
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+// writeLoop sends the frames written by the daemon as messages of the channel until the pipe is closed.
+// The text frame written by serveChannel is the open message. Data frames wait for the window of the channel, which is allowed to go negative by the last message.
+// The close message, carrying the body of the close frame if there is one, is sent last.
+func (ch *muxChannel) writeLoop() {
+	m := ch.m
+	defer m.wg.Done()
+	defer close(ch.done)
+
+	br := bufio.NewReader(ch.peer)
+	var (
+		buf       []byte
+		closeBody []byte
+	)
+loop:
+	for {
+		frame, err := ws.ReadFrame(br)
+		if err != nil {
+			break
+		}
+
+		switch frame.Header.OpCode {
+		case ws.OpText:
+			// the daemon only writes binary frames
+			_, err = m.conn.Write(appendMuxHeader(buf[:0], muxOpen, ch.id, frame.Payload))
+			if err != nil {
+				break loop
+			}
+		case ws.OpPing:
+			// the pings of the connection are sent by pingLoop, and the pong mustn't wait for inputLoop
+			go writeClientFrame(ch.peer, ws.OpPong, nil)
+		case ws.OpClose:
+			closeBody = frame.Payload
+			break loop
+		default:
+			if !ch.wait() {
+				continue
+			}
+			ch.window.Add(-int64(len(frame.Payload)))
+			buf = appendMuxHeader(buf[:0], muxData, ch.id, frame.Payload)
+			_, err = m.conn.Write(buf)
+			if err != nil {
+				break loop
+			}
+		}
+	}
+
+	// writes of the daemon fail instead of blocking once the channel is closed
+	ch.stop()
+	m.remove(ch)
+	_, _ = m.conn.Write(appendMuxHeader(buf[:0], muxClose, ch.id, closeBody))
+}
+
+// wait waits for the window of the channel to open. It returns false if the channel is stopped.
+func (ch *muxChannel) wait() bool {
+	for ch.window.Load() <= 0 {
+		select {
+		case <-ch.more:
+		case <-ch.stopped:
+			return false
+		}
+	}
+	return true
+}
+
+// stop closes the end of the pipe of the mux, which ends the daemon as if the client closed the connection.
+func (ch *muxChannel) stop() {
+	ch.stopOnce.Do(func() {
+		close(ch.stopped)
+		_ = ch.peer.Close()
+	})
+}
+
+func (ch *muxChannel) LocalAddr() net.Addr {
+	return ch.m.conn.conn.LocalAddr()
+}
+
+func (ch *muxChannel) RemoteAddr() net.Addr {
+	return ch.m.conn.conn.RemoteAddr()
+}
+
+// Close closes the pipe, the frames written so far are still sent by writeLoop.
+func (ch *muxChannel) Close() error {
+	err := ch.Conn.Close()
+	ch.stop()
+	return err
+}
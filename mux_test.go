@@ -0,0 +1,109 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// dialMux connects a client of MuxProtocol, whose reads and writes fail after 5 seconds.
+func dialMux(t *testing.T, url string) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := ws.Dialer{
+		Protocols: []string{MuxProtocol},
+	}
+	conn, _, _, err := dialer.Dial(ctx, strings.Replace(url, "http", "ws", 1))
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestMuxClientLimit(t *testing.T) {
+	h := NewCommandHandler(shell("sleep 5"), EnableMultiplexing(0), WithMaxClients(1))
+	conn := dialMux(t, startServer(t, h))
+
+	var err error
+	// each channel is a client, so the second one is refused
+	for id := uint32(1); id <= 2; id++ {
+		err = wsutil.WriteClientBinary(conn, binary.BigEndian.AppendUint32([]byte{muxOpen}, id))
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+
+		var msg []byte
+		// skip the data messages of the opened channels
+		for len(msg) == 0 || msg[0] == muxData {
+			msg, err = wsutil.ReadServerBinary(conn)
+			if err != nil {
+				t.Fatal("read:", err)
+			}
+			if len(msg) < muxHeaderSize {
+				t.Fatalf("channel %d: message %q", id, msg)
+			}
+		}
+		switch {
+		case binary.BigEndian.Uint32(msg[1:]) != id, id == 1 && msg[0] != muxOpen:
+			t.Fatalf("channel %d isn't opened: %q", id, msg)
+		case id == 2 && (msg[0] != muxClose || !strings.Contains(string(msg[muxHeaderSize:]), errTooManyClients.Message)):
+			t.Fatalf("channel %d isn't refused: %q", id, msg)
+		}
+	}
+}
+
+func TestMuxChannelWithoutAcks(t *testing.T) {
+	h := NewCommandHandler(shell("exec yes"), EnableMultiplexing(0))
+	h.stallTimeout = 10 * time.Millisecond
+	conn := dialMux(t, startServer(t, h))
+
+	write := func(op byte, p []byte) {
+		err := wsutil.WriteClientBinary(conn, appendMuxHeader(nil, op, 1, p))
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+	write(muxOpen, nil)
+	write(muxData, []byte(`{"AuthToken":"","columns":80,"rows":24}`))
+
+	// the channel alone in its session is paused by its window instead of closed, however long it isn't acknowledged
+	var received uint32
+	read := func() {
+		msg, err := wsutil.ReadServerBinary(conn)
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+		if msg[0] == muxClose {
+			t.Fatalf("channel closed: %q", msg[muxHeaderSize:])
+		}
+		if msg[0] == muxData {
+			received += uint32(len(msg) - muxHeaderSize)
+		}
+	}
+	for received < MuxWindow {
+		read()
+	}
+	waitFor(t, "the output to stall", func() bool {
+		before := bytesOut(h)
+		time.Sleep(10 * h.stallTimeout)
+		return bytesOut(h) == before
+	})
+
+	write(muxWindow, binary.BigEndian.AppendUint32(nil, received))
+	for window := received; received < window+MuxWindow; {
+		read()
+	}
+}
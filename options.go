@@ -1,6 +1,8 @@
 package ttyd
 
 import (
+	"net/http"
+	"net/netip"
 	"time"
 
 	"github.com/gobwas/ws/wsflate"
@@ -79,3 +81,251 @@ func WithPingInterval(interval time.Duration) HandlerOption {
 		h.pingInterval = interval
 	}
 }
+
+// EnableSessionSharing allows multiple clients to attach to the same session. Clients specify the session ID
+// with the session query parameter, the first client with an ID starts the command, and later clients of the same user
+// with the same ID share its tty, see WithJoinFunc for other users. Clients without an ID get a new session with a random ID, which is reported with SessionHeader.
+// policy decides the size of the tty when the clients have different sizes.
+// A client that stops reading holds up the output of the others for up to 10 seconds, after which it's closed
+// with status 1008, and a paused client is no longer waited for after that long.
+func EnableSessionSharing(policy ResizePolicy) HandlerOption {
+	return func(h *Handler) {
+		h.resizePolicy = policy
+		if h.sessions == nil {
+			h.sessions = make(map[string]*session)
+		}
+	}
+}
+
+// WithJoinFunc decides whether the client of the request may join a running session of another user, such as
+// an administrator watching a user's session. By default, clients can only join or reattach to the sessions started
+// by the same user, as reported by RequestUser, and others are rejected with status 403.
+// The request is nil for HandleTTYD.
+func WithJoinFunc(fn func(r *http.Request, info SessionInfo) bool) HandlerOption {
+	return func(h *Handler) {
+		h.joinFunc = fn
+	}
+}
+
+// WithReadOnlyViewers makes the clients joining an existing session read-only even if client input is enabled.
+// Only the client that started the session can send input to the tty.
+func WithReadOnlyViewers() HandlerOption {
+	return func(h *Handler) {
+		h.readOnlyViewers = true
+	}
+}
+
+// EnableDetach keeps a session running for the grace period after its last client disconnects, so that a client can
+// reattach to it by specifying its ID with the session query parameter. Session IDs work the same way
+// as EnableSessionSharing, a random ID is generated for each client without one and reported with SessionHeader,
+// which acts as the token to reattach to the session.
+// Zero or negative grace disables detaching.
+func EnableDetach(grace time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.detachTimeout = grace
+		if grace > 0 && h.sessions == nil {
+			h.sessions = make(map[string]*session)
+		}
+	}
+}
+
+// WithScrollback sets the number of bytes of the latest output to keep for each session. Output is buffered
+// even if no client is attached, and is replayed to each client that attaches to a running session before the live output.
+// Zero or negative value disables the scrollback.
+func WithScrollback(size int) HandlerOption {
+	return func(h *Handler) {
+		h.scrollback = size
+	}
+}
+
+// EnableRecording records every session in asciicast v2 format to the sink. The recording starts with the initial size
+// of the tty, and contains the output of the process and the changes of the tty size. Client input forwarded to the tty
+// is also recorded if recordInput is true.
+// If the sink fails to create a recording, the session is terminated before the process starts.
+func EnableRecording(sink RecordingSink, recordInput bool) HandlerOption {
+	return func(h *Handler) {
+		h.recordingSink = sink
+		h.recordInput = recordInput
+	}
+}
+
+// OnSessionStart sets the function called after the process of a session is started.
+// It's called before any output is read from the tty, so it shouldn't block.
+func OnSessionStart(fn func(SessionInfo)) HandlerOption {
+	return func(h *Handler) {
+		h.onStart = fn
+	}
+}
+
+// OnSessionEnd sets the function called after the process of a session is waited. It's always called after
+// the OnSessionStart function returns, and only for the sessions whose processes are started.
+func OnSessionEnd(fn func(SessionInfo)) HandlerOption {
+	return func(h *Handler) {
+		h.onEnd = fn
+	}
+}
+
+// EnableURLArgs appends the values of the arg query parameters to the arguments of the command,
+// e.g. ?arg=foo&arg=bar appends foo and bar. The arguments are passed to the process directly without
+// a shell, but the command may still interpret them, such as flags or sh -c scripts, so it's recommended
+// to restrict them with validate. nil validate accepts any arguments.
+// Clients joining an existing session can't pass arguments.
+func EnableURLArgs(validate ArgValidator) HandlerOption {
+	return func(h *Handler) {
+		h.urlArgs = true
+		h.argValidator = validate
+	}
+}
+
+// WithMaxClients sets the maximum number of clients connected at the same time. Clients over the limit are rejected
+// with status 503 before upgrading. Zero or negative value means no limit.
+func WithMaxClients(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxClients = n
+	}
+}
+
+// WithMaxClientsPerIP sets the maximum number of clients connected at the same time from the same IP.
+// Zero or negative value means no limit.
+func WithMaxClientsPerIP(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxClientsPerIP = n
+	}
+}
+
+// WithMaxClientsPerUser sets the maximum number of clients connected at the same time as the same user,
+// as reported by RequestUser. Clients without a user are not limited. Zero or negative value means no limit.
+func WithMaxClientsPerUser(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxClientsPerUser = n
+	}
+}
+
+// OnIdle sets the function called when the last connected client disconnects after a client has been attached
+// to a session, connections rejected before that don't count.
+func OnIdle(fn func()) HandlerOption {
+	return func(h *Handler) {
+		h.onIdle = fn
+	}
+}
+
+// EnableTokenAuth requires clients to send a valid token issued by t for their user in the first message.
+// The token is verified before the process is started, and clients with invalid, expired or already used tokens
+// are disconnected with a policy violation close frame. The user is the one reported by RequestUser, which is empty for HandleTTYD.
+func EnableTokenAuth(t *TokenAuth) HandlerOption {
+	return func(h *Handler) {
+		h.tokens = t
+	}
+}
+
+// WithAuthHeader authenticates the clients by the user name in the header set by a reverse proxy, such as
+// an SSO proxy. The header is only trusted if the request comes from one of the trusted prefixes or a unix socket,
+// and requests from elsewhere or without the header are rejected. The user is available with RequestUser,
+// in SessionInfo and as UserEnv in the environment of the command. It has no effect on HandleTTYD.
+func WithAuthHeader(header string, trusted ...netip.Prefix) HandlerOption {
+	return func(h *Handler) {
+		h.authHeader = header
+		h.trustedProxies = trusted
+	}
+}
+
+// CheckOrigin rejects WebSocket requests from browsers whose Origin isn't allowed with status 403, to prevent
+// cross-site WebSocket hijacking. If no origins are specified, only the same origin as the request host is allowed.
+// Otherwise, each origin is a pattern in the syntax of path.Match, matched against the scheme and host of the Origin,
+// such as https://*.example.com, or against the host only if it has no scheme, such as example.com:7681.
+// Requests without Origin are allowed as they don't come from browsers.
+func CheckOrigin(origins ...string) HandlerOption {
+	return func(h *Handler) {
+		h.originCheck = true
+		h.allowedOrigins = origins
+	}
+}
+
+// WithWritableFunc decides whether client input is forwarded to the tty for each request, for example based on
+// the user reported by RequestUser. It overrides EnableClientInput for the clients served by ServeHTTP.
+func WithWritableFunc(fn func(r *http.Request) bool) HandlerOption {
+	return func(h *Handler) {
+		h.writableFunc = fn
+	}
+}
+
+// WithRateLimiter limits how often new sessions are started. The limiter is asked with the keys ip:<client IP>,
+// as reported by RequestClientIP, and user:<user reported by RequestUser> together before the command is created,
+// and clients over the limit are rejected with status 429 and the Retry-After header. Joining shared sessions is not limited.
+func WithRateLimiter(l RateLimiter) HandlerOption {
+	return func(h *Handler) {
+		h.rateLimiter = l
+	}
+}
+
+// WithAuditSink records the audit trail of the sessions to sink: clients connecting and disconnecting,
+// and processes starting and ending. If recordInput is true, every client input forwarded to the tty is
+// also recorded with the exact bytes. Replays are not audited.
+func WithAuditSink(sink AuditSink, recordInput bool) HandlerOption {
+	return func(h *Handler) {
+		h.auditSink = sink
+		h.auditInput = recordInput
+	}
+}
+
+// WithIdleTimeout disconnects the clients that send no input for the input timeout, or receive no output of
+// the process for the output timeout. Zero or negative value disables the timeout. Read-only clients are
+// idle unless they type anyway, so don't set the input timeout for viewers of shared sessions.
+// The clients are warned in the terminal before they are disconnected, see WithTimeoutWarning.
+func WithIdleTimeout(input, output time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.inputTimeout = input
+		h.outputTimeout = output
+	}
+}
+
+// WithMaxDuration ends the sessions that have run for the duration, regardless of the activity. Its tty is closed,
+// which hangs up the process, and the clients are warned in the terminal before that, see WithTimeoutWarning.
+// Zero or negative value disables the limit.
+func WithMaxDuration(duration time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.maxDuration = duration
+	}
+}
+
+// WithPongTimeout disconnects the clients that don't answer a ping within the timeout, so that dead connections
+// are detected even if writing to them doesn't fail. It requires WithPingInterval.
+// Zero or negative value disables the timeout.
+func WithPongTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.pongTimeout = timeout
+	}
+}
+
+// WithTimeoutWarning sets how long before the idle timeout or the end of the maximum duration the clients are warned
+// in the terminal, which is at most half of the timeout. It's DefaultTimeoutWarning by default.
+// Zero or negative value disables the warning.
+func WithTimeoutWarning(warning time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.timeoutWarning = warning
+	}
+}
+
+// EnableMultiplexing lets clients serve many terminals over one WebSocket connection with MuxProtocol, each in
+// a channel that opens or joins a session the same way as a connection of its own. Every message of MuxProtocol
+// starts with its type and a channel ID chosen by the client as a 32-bit big-endian integer:
+//
+//   - o, the client opens the channel with the URL query of the channel, such as session=ID. The server answers with
+//     an open message carrying the session ID if session sharing or detaching is enabled, or an empty one.
+//   - d, a message of the ttyd protocol in the channel, in either direction.
+//   - w, the receiver of the data messages acknowledges the bytes it consumed, as a 32-bit big-endian integer.
+//   - c, the client asks to close the channel. The server sends exactly one close message for each channel it opens,
+//     carrying the body of the WebSocket close frame, after which the channel ID can be reused.
+//
+// Each side may send MuxWindow bytes of data messages on a channel before they are acknowledged, so a busy terminal
+// whose client stops acknowledging only pauses its own session. If the session is shared with other clients, the channel
+// is closed after a while like a connection that stops reading, see EnableSessionSharing. Each channel counts as one client for
+// the client limits, and maxChannels limits the channels of a connection. Zero or negative maxChannels means no limit.
+// Connections upgraded by other means are multiplexed by HandleTTYD if they negotiated MuxProtocol.
+// Replays aren't multiplexed.
+func EnableMultiplexing(maxChannels int) HandlerOption {
+	return func(h *Handler) {
+		h.multiplexing = true
+		h.maxChannels = maxChannels
+	}
+}
@@ -0,0 +1,41 @@
+package ttyd
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var errForbiddenOrigin = &StatusError{Code: http.StatusForbidden, Message: "origin not allowed"}
+
+// checkOrigin reports whether the Origin of the request is allowed by the origin policy.
+// Requests without Origin are not from browsers, and can't be used for cross-site WebSocket hijacking.
+func (h *Handler) checkOrigin(r *http.Request) bool {
+	if !h.originCheck {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if len(h.allowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, pattern := range h.allowedOrigins {
+		target := origin
+		if !strings.Contains(pattern, "://") {
+			target = strings.ToLower(u.Host)
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), target); ok {
+			return true
+		}
+	}
+	return false
+}
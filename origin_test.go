@@ -0,0 +1,56 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	for _, tt := range []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{nil, "", true},
+		{nil, "http://example.com", true},
+		{nil, "https://EXAMPLE.com", true},
+		{nil, "http://evil.com", false},
+		{nil, "http://example.com.evil.com", false},
+		{nil, "null", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com", true},
+		{[]string{"https://*.example.com"}, "http://app.example.com", false},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com.evil.com", false},
+		{[]string{"example.com:7681"}, "http://example.com:7681", true},
+		{[]string{"example.com:7681"}, "https://example.com:7681", true},
+		{[]string{"example.com:7681"}, "http://example.com", false},
+	} {
+		h := NewCommandHandler(nil, CheckOrigin(tt.origins...))
+		r := httptest.NewRequest("GET", "http://example.com/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if allowed := h.checkOrigin(r); allowed != tt.allowed {
+			t.Errorf("origins %q: %q allowed = %v", tt.origins, tt.origin, allowed)
+		}
+	}
+}
+
+func TestCrossOriginRejected(t *testing.T) {
+	url := startServer(t, NewCommandHandler(shell("echo hello"), CheckOrigin()))
+
+	_, err := client.Dial(context.Background(), url, client.WithToken(""), client.WithHeader("Origin", "https://evil.com"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("cross-origin dial = %v", err)
+	}
+	out, _ := readAll(t, dial(t, url, client.WithHeader("Origin", url)))
+	if !strings.Contains(out, "hello") {
+		t.Fatalf("same origin output = %q", out)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalProcess sends the signal to the process group of the process, which is the session leader of its tty.
+func signalProcess(p *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-p.Pid, sig)
+}
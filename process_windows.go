@@ -0,0 +1,15 @@
+//go:build windows
+
+package ttyd
+
+import (
+	"os"
+	"syscall"
+)
+
+func signalProcess(p *os.Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return p.Kill()
+	}
+	return p.Signal(sig)
+}
@@ -0,0 +1,152 @@
+package ttyd
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is the minimum interval between removals of the idle buckets.
+const rateLimitSweepInterval = time.Minute
+
+// A RateLimiter decides whether an event of a client identified by the keys, such as its IP and its user, is allowed.
+// The event is only counted if it's allowed for every key, so that a key over the limit doesn't use up the others.
+// If it's not allowed, the returned duration is how long the client should wait before retrying.
+type RateLimiter interface {
+	Allow(keys ...string) (bool, time.Duration)
+}
+
+// TokenBucket is a RateLimiter with a token bucket per key. Each event consumes a token, and keys running out
+// of tokens are banned for a while.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	ban   time.Duration
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	until  time.Time
+}
+
+// NewTokenBucket returns a TokenBucket whose buckets hold up to burst tokens and are refilled with rate tokens
+// per second. Keys running out of tokens are banned for ban, and get a full bucket after the ban.
+// If ban is zero, keys are only limited until the next token is available.
+func NewTokenBucket(rate float64, burst int, ban time.Duration) *TokenBucket {
+	return &TokenBucket{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		ban:     ban,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow consumes a token of each key if none of them is banned or out of tokens.
+func (t *TokenBucket) Allow(keys ...string) (bool, time.Duration) {
+	return t.take(keys, true)
+}
+
+// Check is like Allow, but doesn't consume tokens. It's used to reject banned clients before counting failures.
+func (t *TokenBucket) Check(keys ...string) (bool, time.Duration) {
+	return t.take(keys, false)
+}
+
+func (t *TokenBucket) take(keys []string, consume bool) (bool, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.sweep(now)
+
+	buckets := make([]*bucket, 0, len(keys))
+	var retryAfter time.Duration
+	for _, key := range keys {
+		b := t.bucket(key, now)
+		switch {
+		case now.Before(b.until):
+			retryAfter = max(retryAfter, b.until.Sub(now))
+		case b.tokens < 1:
+			retryAfter = max(retryAfter, t.wait(b))
+		default:
+			buckets = append(buckets, b)
+		}
+	}
+	if len(buckets) < len(keys) {
+		return false, retryAfter
+	}
+	if consume {
+		for _, b := range buckets {
+			b.tokens--
+			if b.tokens < 1 && t.ban > 0 {
+				b.until = now.Add(t.ban)
+			}
+		}
+	}
+	return true, 0
+}
+
+// bucket returns the bucket of the key refilled until now, or a full one if the key has none. The lock must be held.
+func (t *TokenBucket) bucket(key string, now time.Time) *bucket {
+	b := t.buckets[key]
+	if b == nil {
+		b = &bucket{
+			tokens: t.burst,
+			last:   now,
+		}
+		t.buckets[key] = b
+	}
+	b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+
+	if !b.until.IsZero() && !now.Before(b.until) {
+		// the ban is over, start afresh
+		b.until = time.Time{}
+		b.tokens = t.burst
+	}
+	return b
+}
+
+// wait returns how long until the next token is available.
+func (t *TokenBucket) wait(b *bucket) time.Duration {
+	if t.rate <= 0 {
+		return t.ban
+	}
+	return time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+}
+
+// sweep removes the buckets that are full and not banned, as they are the same as new ones.
+func (t *TokenBucket) sweep(now time.Time) {
+	if now.Sub(t.swept) < rateLimitSweepInterval {
+		return
+	}
+	t.swept = now
+	for key, b := range t.buckets {
+		if now.After(b.until) && b.tokens+now.Sub(b.last).Seconds()*t.rate >= t.burst {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// TooManyRequests replies to the request with status 429 and the Retry-After header in seconds.
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// allowSession reports whether the client is allowed to start a new session by the rate limiter.
+func (h *Handler) allowSession(ip, user string) (bool, time.Duration) {
+	if h.rateLimiter == nil {
+		return true, 0
+	}
+	keys := []string{"ip:" + ip}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return h.rateLimiter.Allow(keys...)
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestRateLimiterClientIP(t *testing.T) {
+	h := NewCommandHandler(shell("echo hello"), WithRateLimiter(NewTokenBucket(0.001, 1, 0)))
+	url := startServer(t, FilterIP(h, IPRules{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}))
+
+	// the clients behind the proxy are limited by their own IPs
+	for _, tt := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+	} {
+		conn, err := client.Dial(context.Background(), url, client.WithToken(""), client.WithHeader("X-Forwarded-For", tt.ip))
+		if tt.allowed != (err == nil) {
+			t.Fatalf("%s: dial = %v", tt.ip, err)
+		}
+		if err == nil {
+			_ = conn.Close()
+		} else if !strings.Contains(err.Error(), "429") {
+			t.Fatalf("%s: dial = %v", tt.ip, err)
+		}
+	}
+}
+
+func TestTokenBucketKeys(t *testing.T) {
+	tb := NewTokenBucket(0.001, 1, time.Minute)
+	if ok, _ := tb.Allow("user:alice"); !ok {
+		t.Fatal("first session of alice is limited")
+	}
+
+	// the IP keeps its token when the user is over the limit
+	ok, retryAfter := tb.Allow("ip:192.0.2.1", "user:alice")
+	if ok || retryAfter <= 0 || retryAfter > time.Minute {
+		t.Fatalf("banned user allowed = %v, retry after %v", ok, retryAfter)
+	}
+	if ok, _ = tb.Check("ip:192.0.2.1"); !ok {
+		t.Fatal("the token of the ip is consumed by a rejected event")
+	}
+	if ok, _ = tb.Allow("ip:192.0.2.1", "user:bob"); !ok {
+		t.Fatal("other user of the ip is limited")
+	}
+}
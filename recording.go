@@ -0,0 +1,166 @@
+package ttyd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A RecordingSink stores the recordings of sessions in asciicast v2 format.
+type RecordingSink interface {
+	// Create returns the writer for the recording of a new session. It's called when the process is about to start,
+	// and the writer is closed after the session ends.
+	Create(id string, cmd *exec.Cmd) (io.WriteCloser, error)
+}
+
+// DirRecordingSink returns a RecordingSink that creates a file for each session in dir.
+// Files are named after the start time and the session ID with the .cast extension.
+func DirRecordingSink(dir string) RecordingSink {
+	return dirSink(dir)
+}
+
+type dirSink string
+
+func (d dirSink) Create(id string, _ *exec.Cmd) (io.WriteCloser, error) {
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r < utf8.RuneSelf && (r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, id) + ".cast"
+	return os.OpenFile(filepath.Join(string(d), name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+}
+
+// castHeader is the header of an asciicast v2 file.
+type castHeader struct {
+	Version   int    `json:"version"`
+	Width     uint16 `json:"width"`
+	Height    uint16 `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+const (
+	castOutput = "o"
+	castInput  = "i"
+	castResize = "r"
+)
+
+// recorder writes the events of a session as an asciicast v2 stream.
+// Incomplete UTF-8 sequences at the end of output and input are held until the next event of the same type,
+// because event data must be valid JSON strings.
+type recorder struct {
+	lock  sync.Mutex
+	w     io.WriteCloser
+	start time.Time
+	input bool
+
+	buf     bytes.Buffer
+	enc     *json.Encoder
+	data    []byte
+	outTail []byte
+	inTail  []byte
+	err     error
+}
+
+func newRecorder(w io.WriteCloser, header castHeader, input bool) (*recorder, error) {
+	r := &recorder{
+		w:     w,
+		start: time.Now(),
+		input: input,
+	}
+	r.enc = json.NewEncoder(&r.buf)
+	r.enc.SetEscapeHTML(false)
+
+	header.Version = 2
+	header.Timestamp = r.start.Unix()
+	_ = r.enc.Encode(header)
+	_, err := r.buf.WriteTo(w)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) output(p []byte) {
+	r.lock.Lock()
+	r.outTail = r.write(castOutput, r.outTail, p)
+	r.lock.Unlock()
+}
+
+func (r *recorder) inputData(p []byte) {
+	if !r.input {
+		return
+	}
+
+	r.lock.Lock()
+	r.inTail = r.write(castInput, r.inTail, p)
+	r.lock.Unlock()
+}
+
+func (r *recorder) resize(cols, rows uint16) {
+	r.lock.Lock()
+	r.data = strconv.AppendUint(r.data[:0], uint64(cols), 10)
+	r.data = append(r.data, 'x')
+	r.data = strconv.AppendUint(r.data, uint64(rows), 10)
+	r.event(castResize, r.data)
+	r.lock.Unlock()
+}
+
+// write records p prefixed by the tail of the previous event of the same type, and returns the new tail.
+func (r *recorder) write(code string, tail, p []byte) []byte {
+	r.data = append(append(r.data[:0], tail...), p...)
+	n := incompleteSuffix(r.data)
+	tail = append(tail[:0], r.data[len(r.data)-n:]...)
+	if len(r.data) > n {
+		r.event(code, r.data[:len(r.data)-n])
+	}
+	return tail
+}
+
+func (r *recorder) event(code string, data []byte) {
+	if r.err != nil {
+		return
+	}
+
+	r.buf.WriteByte('[')
+	r.buf.Write(strconv.AppendFloat(r.buf.AvailableBuffer(), time.Since(r.start).Seconds(), 'f', 6, 64))
+	r.buf.WriteString(`, "`)
+	r.buf.WriteString(code)
+	r.buf.WriteString(`", `)
+	_ = r.enc.Encode(string(data))
+	r.buf.Truncate(r.buf.Len() - 1)
+	r.buf.WriteString("]\n")
+	_, r.err = r.buf.WriteTo(r.w)
+}
+
+func (r *recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.outTail) > 0 {
+		r.event(castOutput, r.outTail)
+	}
+	return r.w.Close()
+}
+
+// incompleteSuffix returns the length of the incomplete UTF-8 sequence at the end of p.
+func incompleteSuffix(p []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// castEvents returns the code and data of each event in the recording.
+func castEvents(t *testing.T, cast string) []string {
+	t.Helper()
+	lines := strings.Split(strings.TrimSuffix(cast, "\n"), "\n")
+	var header castHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Version != 2 {
+		t.Fatalf("header = %q, %v", lines[0], err)
+	}
+	var events []string
+	for _, line := range lines[1:] {
+		var event []any
+		if err := json.Unmarshal([]byte(line), &event); err != nil || len(event) != 3 {
+			t.Fatalf("event = %q, %v", line, err)
+		}
+		events = append(events, event[1].(string)+" "+event[2].(string))
+	}
+	return events
+}
+
+func TestRecorderSplitUTF8(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := newRecorder(nopWriteCloser{&buf}, castHeader{Width: 80, Height: 24}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "世界" split inside both runes, and the incomplete input is held apart from the output
+	r.output([]byte("a\xe4\xb8"))
+	r.inputData([]byte("\xe7"))
+	r.output([]byte("\x96\xe7\x95"))
+	r.inputData([]byte("\x95\x8c"))
+	r.output([]byte("\x8cb"))
+	r.resize(100, 30)
+	r.output([]byte("\xe4"))
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := castEvents(t, buf.String())
+	want := []string{"o a", "o 世", "i 界", "o 界b", "r 100x30", "o �"}
+	if !slices.Equal(events, want) {
+		t.Fatalf("events = %q, want %q", events, want)
+	}
+}
+
+func TestIncompleteSuffix(t *testing.T) {
+	for _, tt := range []struct {
+		p string
+		n int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"a世", 0},
+		{"a\xe4", 1},
+		{"a\xe4\xb8", 2},
+		{"\xf0\x9f\x98", 3},
+		{"\xf0\x9f\x98\x80", 0},
+		{"\x80\x80\x80\x80", 0},
+	} {
+		if n := incompleteSuffix([]byte(tt.p)); n != tt.n {
+			t.Errorf("incompleteSuffix(%q) = %d, want %d", tt.p, n, tt.n)
+		}
+	}
+}
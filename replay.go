@@ -0,0 +1,260 @@
+package ttyd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+var errUnsupportedRecording = errors.New("ttyd: unsupported recording format")
+
+// A RecordingFunc returns the asciicast v2 recording to play for a request. The request is nil
+// if the recording is played by HandleTTYD.
+// Returned error is reported to the client the same way as CommandFunc.
+type RecordingFunc func(r *http.Request) (io.ReadCloser, error)
+
+// ReplayFile returns a RecordingFunc that always plays the named file.
+func ReplayFile(name string) RecordingFunc {
+	return func(*http.Request) (io.ReadCloser, error) {
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &StatusError{Code: http.StatusNotFound}
+		}
+		return f, err
+	}
+}
+
+// NewReplayHandler returns a new Handler that plays the recording returned by fn to the clients
+// instead of running commands, with the original timing of the output events.
+// Clients can set the playback speed with the speed query parameter, and cap the idle time
+// between events in seconds with the idle query parameter. Pausing is supported, while client input
+// and resizing are ignored.
+// Options about commands and sessions have no effect, others are the same as NewHandler.
+func NewReplayHandler(fn RecordingFunc, options ...HandlerOption) *Handler {
+	return newHandler(&Handler{recordingFunc: fn}, options)
+}
+
+// player plays a recording to a client.
+type player struct {
+	d     *daemon
+	rc    io.ReadCloser
+	dec   *json.Decoder
+	speed float64
+	idle  time.Duration
+	title string
+	done  chan struct{}
+}
+
+// newPlayer opens the recording, and reads its header.
+func (h *Handler) newPlayer(r *http.Request) (*player, error) {
+	rc, err := h.recordingFunc(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &player{
+		rc:    rc,
+		dec:   json.NewDecoder(bufio.NewReader(rc)),
+		speed: 1,
+		done:  make(chan struct{}),
+	}
+	if r != nil {
+		query := r.URL.Query()
+		if speed := query.Get("speed"); speed != "" {
+			p.speed, err = strconv.ParseFloat(speed, 64)
+			if err != nil || p.speed <= 0 {
+				_ = rc.Close()
+				return nil, &StatusError{Code: http.StatusBadRequest, Message: "invalid speed"}
+			}
+		}
+		if idle := query.Get("idle"); idle != "" {
+			seconds, err := strconv.ParseFloat(idle, 64)
+			if err != nil || seconds <= 0 {
+				_ = rc.Close()
+				return nil, &StatusError{Code: http.StatusBadRequest, Message: "invalid idle"}
+			}
+			p.idle = time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	var header castHeader
+	err = p.dec.Decode(&header)
+	if err == nil && header.Version != 2 {
+		err = errUnsupportedRecording
+	}
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+
+	if h.title == "" {
+		switch {
+		case header.Title != "":
+			p.title = header.Title
+		case header.Command != "":
+			p.title = header.Command
+		default:
+			p.title = "asciicast"
+		}
+	}
+	return p, nil
+}
+
+func (h *Handler) serveReplay(w http.ResponseWriter, r *http.Request) {
+	p, err := h.newPlayer(r)
+	if err != nil {
+		code, msg := errorStatus(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer p.rc.Close()
+
+	conn, brw, hs, err := h.upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	h.replay(r.Context(), r, p, conn, brw, hs)
+}
+
+func (h *Handler) handleReplay(ctx context.Context, conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) {
+	p, err := h.newPlayer(nil)
+	if err != nil {
+		closeError(conn, brw, err)
+		return
+	}
+	defer p.rc.Close()
+
+	h.replay(ctx, nil, p, conn, brw, hs)
+}
+
+func (h *Handler) replay(ctx context.Context, r *http.Request, p *player, conn net.Conn, brw *bufio.ReadWriter, hs ws.Handshake) {
+	addr, user := remoteAddr(r, conn), RequestUser(r)
+	ip := addrIP(addr)
+	if !h.acquire(ip, user) {
+		closeError(conn, brw, errTooManyClients)
+		return
+	}
+	defer h.release(ip, user, true)
+
+	p.d = h.newDaemon(conn, brw, hs)
+	p.d.remoteAddr = addr
+	p.d.user = user
+	if p.title != "" {
+		p.d.title = p.title
+	}
+	h.run(ctx, p.d, p.readLoop)
+}
+
+// readLoop starts playing after the client reports its size, and handles flow control.
+func (p *player) readLoop() error {
+	defer close(p.done)
+	d := p.d
+	err := d.initWrite()
+	if err != nil {
+		return err
+	}
+
+	var (
+		cmd     byte
+		started bool
+	)
+	for !d.ioErr.Load() {
+		cmd, err = d.nextMessage()
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case pause:
+			d.paused.Store(true)
+		case resume:
+			d.paused.Store(false)
+			select {
+			case d.resume <- struct{}{}:
+			default:
+			}
+		case jsonData:
+			if !started {
+				_ = d.conn.rb.UnreadByte()
+				var rr initRequest
+				err = json.NewDecoder(&d.conn.rb).Decode(&rr)
+				if err != nil {
+					return errInvalidMessage
+				}
+
+				err = d.verifyToken(rr.AuthToken)
+				if err != nil {
+					return err
+				}
+
+				started = true
+				go p.playLoop()
+			}
+		}
+	}
+	return nil
+}
+
+// playLoop writes the output events to the client, and closes the connection when the recording ends.
+func (p *player) playLoop() {
+	var (
+		event [3]json.RawMessage
+		code  string
+		last  float64
+		msg   []byte
+	)
+	timer := time.NewTimer(0)
+	<-timer.C
+	for !p.d.ioErr.Load() {
+		err := p.dec.Decode(&event)
+		if err != nil {
+			break
+		}
+
+		var at float64
+		if json.Unmarshal(event[0], &at) != nil || json.Unmarshal(event[1], &code) != nil || code != castOutput {
+			continue
+		}
+
+		var data string
+		if json.Unmarshal(event[2], &data) != nil {
+			continue
+		}
+
+		if p.d.paused.Load() {
+			<-p.d.resume
+		}
+
+		delay := time.Duration((at - last) * float64(time.Second))
+		last = at
+		if p.idle > 0 && delay > p.idle {
+			delay = p.idle
+		}
+		if delay = time.Duration(float64(delay) / p.speed); delay > 0 {
+			timer.Reset(delay)
+			select {
+			case <-timer.C:
+			case <-p.done:
+				timer.Stop()
+				return
+			}
+		}
+
+		msg = append(append(msg[:0], output), data...)
+		_, err = p.d.conn.Write(msg)
+		if err != nil {
+			break
+		}
+	}
+	p.d.close(ReasonProcessExit, ws.StatusNormalClosure, "")
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestReplay(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.cast")
+	err := os.WriteFile(name, []byte(`{"version":2,"width":80,"height":24}
+[0.5,"o","hello "]
+[1,"i","ignored"]
+[1.5,"o","world"]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewReplayHandler(ReplayFile(name))
+	if d := NewCommandHandler(nil); h.messageSizeLimit != d.messageSizeLimit || h.stallTimeout != d.stallTimeout || h.timeoutWarning != d.timeoutWarning {
+		t.Fatal("the defaults of the replay handler differ from NewCommandHandler")
+	}
+	out, ce := readAll(t, dial(t, startServer(t, h)+"/?speed=100"))
+	if (ce != nil && ce.Code != ws.StatusNormalClosure) || out != "hello world" {
+		t.Fatalf("replay = %q, %v", out, ce)
+	}
+}
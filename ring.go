@@ -0,0 +1,43 @@
+package ttyd
+
+// ring is a fixed size buffer that keeps the latest bytes written to it.
+type ring struct {
+	buf  []byte
+	head int
+	full bool
+}
+
+func newRing(size int) *ring {
+	return &ring{
+		buf: make([]byte, size),
+	}
+}
+
+func (r *ring) Write(p []byte) {
+	if len(p) >= len(r.buf) {
+		copy(r.buf, p[len(p)-len(r.buf):])
+		r.head = 0
+		r.full = true
+		return
+	}
+
+	n := copy(r.buf[r.head:], p)
+	if n < len(p) {
+		r.head = copy(r.buf, p[n:])
+		r.full = true
+	} else {
+		r.head += n
+	}
+	if r.head == len(r.buf) {
+		r.head = 0
+		r.full = true
+	}
+}
+
+// chunks returns the buffered bytes in order as at most two slices.
+func (r *ring) chunks() (first, second []byte) {
+	if !r.full {
+		return r.buf[:r.head], nil
+	}
+	return r.buf[r.head:], r.buf[:r.head]
+}
@@ -0,0 +1,589 @@
+package ttyd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gobwas/ws"
+)
+
+// SessionHeader is the response header that carries the ID of the session a client is attached to
+// when session sharing is enabled.
+const SessionHeader = "X-Ttyd-Session"
+
+var errSessionClosed = errors.New("session closed")
+
+// ResizePolicy decides the size of the tty when the clients attached to a session have different sizes.
+type ResizePolicy int
+
+const (
+	// ResizeSmallest uses the smallest columns and rows among the clients, so every client can see the whole screen.
+	ResizeSmallest ResizePolicy = iota
+	// ResizeLargest uses the largest columns and rows among the clients.
+	ResizeLargest
+	// ResizeOwner uses the size of the client that attached first. When it leaves, the next oldest client
+	// becomes the owner.
+	ResizeOwner
+)
+
+func newSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// session is a process running in a tty and the clients attached to it.
+type session struct {
+	h      *Handler
+	id     string
+	cmd    *exec.Cmd
+	file   *os.File
+	policy ResizePolicy
+
+	lock       sync.Mutex
+	clients    []*daemon
+	size       pty.Winsize
+	closing    bool
+	closed     bool
+	snapshot   []*daemon
+	full       []*daemon
+	buf        []byte
+	scrollback *ring
+	timer      *time.Timer
+	recorder   *recorder
+	writable   bool
+	flipped    bool
+
+	request    *http.Request
+	remoteAddr string
+	user       string
+	startTime  time.Time
+	endTime    time.Time
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	lastOutput atomic.Int64
+	reason     TerminationReason
+	reasonSet  bool
+	waited     chan struct{}
+}
+
+// add attaches the client to the session. It fails if the session is closing.
+func (s *session) add(d *daemon) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return false
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	d.session = s
+	s.clients = append(s.clients, d)
+	return true
+}
+
+// detach removes the client from the session. If it's the last client, the session is closed,
+// or kept running for the detach grace period if the process is already started.
+func (s *session) detach(d *daemon) {
+	s.lock.Lock()
+	idx := slices.Index(s.clients, d)
+	if idx >= 0 {
+		s.clients = slices.Delete(s.clients, idx, idx+1)
+	}
+	last := len(s.clients) == 0 && !s.closing
+	switch {
+	case last && s.file != nil && s.h.detachTimeout > 0:
+		last = false
+		if s.timer == nil {
+			s.timer = time.AfterFunc(s.detachGrace(), s.expire)
+		}
+	case last:
+		s.closing = true
+		s.setReason(d.reason)
+	case idx >= 0 && s.file != nil:
+		_ = s.resize()
+	}
+	s.lock.Unlock()
+
+	if last {
+		s.close()
+	}
+}
+
+// expire closes the session if no client has reattached during the grace period, or the maximum duration is reached.
+func (s *session) expire() {
+	s.lock.Lock()
+	expired := len(s.clients) == 0 && !s.closing
+	if expired {
+		s.closing = true
+		if s.h.maxDuration > 0 && time.Since(s.startTime) >= s.h.maxDuration {
+			s.setReason(ReasonTimeLimit)
+		} else {
+			s.setReason(ReasonDetachTimeout)
+		}
+	}
+	s.lock.Unlock()
+
+	if expired {
+		s.close()
+	}
+}
+
+// setReason records the reason the session ends unless one is already recorded. The lock must be held.
+func (s *session) setReason(reason TerminationReason) {
+	if !s.reasonSet {
+		s.reason = reason
+		s.reasonSet = true
+	}
+}
+
+// replay queues the scrollback for the client as output messages. The lock must be held.
+func (s *session) replay(d *daemon) {
+	if s.scrollback == nil {
+		return
+	}
+
+	first, second := s.scrollback.chunks()
+	for _, b := range [2][]byte{first, second} {
+		for len(b) > 0 {
+			n := min(len(b), len(s.buf)-1)
+			msg := make([]byte, 1+n)
+			msg[0] = output
+			copy(msg[1:], b[:n])
+			// the scrollback is bounded, and the client can't be stalled yet as nothing was queued for it
+			d.enqueue(msg, true)
+			b = b[n:]
+		}
+	}
+}
+
+// setSize records the size of the client. The process is started with the size of the first client
+// that reports its size, later sizes are applied according to the resize policy.
+func (s *session) setSize(d *daemon, size pty.Winsize) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil && !d.sized {
+		s.replay(d)
+	}
+	if s.flipped && !d.sized {
+		// the client was writing the initial messages when it got the writability set by SetWritable
+		defer d.notify(writablePreference(d.writable.Load()))
+	}
+	d.size = size
+	d.sized = true
+	if s.file != nil {
+		return s.resize()
+	}
+	if s.closing {
+		return errSessionClosed
+	}
+
+	if s.h.recordingSink != nil {
+		w, err := s.h.recordingSink.Create(s.id, s.cmd)
+		if err != nil {
+			return err
+		}
+
+		s.recorder, err = newRecorder(w, castHeader{
+			Width:   size.Cols,
+			Height:  size.Rows,
+			Command: strings.Join(s.cmd.Args, " "),
+			Title:   s.h.title,
+		}, s.h.recordInput)
+		if err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+
+	file, err := pty.StartWithSize(s.cmd, &size)
+	if err != nil {
+		return err
+	}
+
+	err = setNonblock(file)
+	if err != nil {
+		_ = file.Close()
+		_ = s.cmd.Wait()
+		return err
+	}
+
+	s.file = file
+	s.size = size
+	s.startTime = time.Now()
+	s.waited = make(chan struct{})
+	s.buf = make([]byte, d.conn.brw.Writer.Size()-ws.MaxHeaderSize)
+	if s.h.scrollback > 0 {
+		s.scrollback = newRing(s.h.scrollback)
+	}
+	if s.h.auditSink != nil {
+		// recorded before any input of the clients
+		s.audit(AuditStart, s.info())
+	}
+	go s.writeLoop()
+	return nil
+}
+
+// resize applies the size decided by the resize policy to the tty. The lock must be held.
+func (s *session) resize() error {
+	var size pty.Winsize
+	for _, d := range s.clients {
+		if !d.sized {
+			continue
+		}
+
+		switch {
+		case size.Rows == 0 && size.Cols == 0:
+			size = d.size
+		case s.policy == ResizeSmallest:
+			size.Rows = min(size.Rows, d.size.Rows)
+			size.Cols = min(size.Cols, d.size.Cols)
+		case s.policy == ResizeLargest:
+			size.Rows = max(size.Rows, d.size.Rows)
+			size.Cols = max(size.Cols, d.size.Cols)
+		}
+		if s.policy == ResizeOwner {
+			break
+		}
+	}
+	if size == (pty.Winsize{}) || size == s.size {
+		return nil
+	}
+
+	s.size = size
+	if s.recorder != nil {
+		s.recorder.resize(size.Cols, size.Rows)
+	}
+	err := pty.Setsize(s.file, &size)
+	if err != nil {
+		return err
+	}
+	return setNonblock(s.file)
+}
+
+// writeLoop broadcasts the output of the process until the tty is closed, and runs the lifecycle hooks.
+func (s *session) writeLoop() {
+	if s.h.onStart != nil {
+		s.lock.Lock()
+		info := s.info()
+		s.lock.Unlock()
+		s.h.onStart(info)
+	}
+
+	buf := s.buf
+	for {
+		buf[0] = output
+		n, err := s.file.Read(buf[1:])
+		if err != nil {
+			break
+		}
+
+		s.bytesOut.Add(int64(n))
+		s.lastOutput.Store(time.Now().UnixNano())
+		s.broadcast(buf[:1+n])
+	}
+
+	s.lock.Lock()
+	s.setReason(ReasonProcessExit)
+	s.lock.Unlock()
+	s.close()
+
+	<-s.waited
+	if s.h.onEnd != nil || s.h.auditSink != nil {
+		s.lock.Lock()
+		info := s.info()
+		s.lock.Unlock()
+		s.audit(AuditEnd, info)
+		if s.h.onEnd != nil {
+			s.h.onEnd(info)
+		}
+	}
+}
+
+// broadcast queues the message for every client that has reported its size. Clients that haven't reported their sizes
+// will receive the scrollback when they do. The output isn't read further while a client's queue is full or
+// a client is paused, like without session sharing. Clients that share the session with others are only waited for
+// up to stallTimeout in total, see await.
+func (s *session) broadcast(p []byte) {
+	msg := bytes.Clone(p)
+	s.lock.Lock()
+	if s.scrollback != nil {
+		s.scrollback.Write(p[1:])
+	}
+	if s.recorder != nil {
+		s.recorder.output(p[1:])
+	}
+	s.snapshot = s.snapshot[:0]
+	s.full = s.full[:0]
+	for _, d := range s.clients {
+		if !d.sized {
+			continue
+		}
+		s.snapshot = append(s.snapshot, d)
+		if !d.enqueue(msg, false) {
+			s.full = append(s.full, d)
+		}
+	}
+	s.lock.Unlock()
+
+	var deadline time.Time
+	for _, d := range s.snapshot {
+		full := slices.Contains(s.full, d)
+		if !full && !d.paused.Load() {
+			continue
+		}
+		if deadline.IsZero() {
+			deadline = time.Now().Add(s.h.stallTimeout)
+		}
+		s.await(d, msg, full, deadline)
+	}
+}
+
+// await queues the message for the client once it has space if it's full, and then waits for it to resume if
+// it's paused. A client alone in the session is waited for as long as it takes, as it only holds up its own output.
+// Otherwise, at the deadline, the client is dropped if it's still full, or no longer waited for if it's still paused.
+func (s *session) await(d *daemon, msg []byte, full bool, deadline time.Time) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		if full && d.enqueue(msg, false) {
+			full = false
+		}
+		if !full && !d.paused.Load() {
+			return
+		}
+
+		select {
+		case <-d.space:
+		case _, ok := <-d.resume:
+			if !ok {
+				// readLoop has ended, the client is closing
+				return
+			}
+		case <-d.written:
+			return
+		case <-timer.C:
+			if !s.shared(d) {
+				timer.Reset(s.h.stallTimeout)
+				continue
+			}
+			if full {
+				d.drop()
+			}
+			return
+		}
+	}
+}
+
+// shared reports whether other clients that have reported their sizes are attached to the session.
+func (s *session) shared(d *daemon) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.ContainsFunc(s.clients, func(c *daemon) bool {
+		return c != d && c.sized
+	})
+}
+
+// close closes the tty and waits for the process to exit if it's started, and then disconnects all the clients
+// with the exit status of the process as the reason of the close frame.
+func (s *session) close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closing = true
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	clients := s.clients
+	s.clients = nil
+	s.lock.Unlock()
+
+	s.h.removeSession(s)
+	var status string
+	if s.file != nil {
+		_ = s.file.Close()
+		_ = s.cmd.Wait()
+		s.lock.Lock()
+		s.endTime = time.Now()
+		s.lock.Unlock()
+		close(s.waited)
+		if s.cmd.ProcessState != nil {
+			status = s.cmd.ProcessState.String()
+		}
+	}
+	for _, d := range clients {
+		d.close(ReasonProcessExit, ws.StatusNormalClosure, status)
+	}
+	if s.recorder != nil {
+		_ = s.recorder.Close()
+	}
+}
+
+// attach attaches the client to the session with the id, or a new session running cmd if there isn't one.
+// Sessions are only registered if session sharing is enabled, otherwise they get random IDs. If cmd is nil, the CommandFunc is called to create one.
+// Sessions of other users can only be joined if the join function allows it.
+func (h *Handler) attach(r *http.Request, id string, cmd *exec.Cmd, d *daemon) error {
+	var allowed *session
+	for {
+		h.sessionLock.Lock()
+		if h.shutdown {
+			h.sessionLock.Unlock()
+			return errShutdown
+		}
+
+		s := h.sessions[id]
+		if s != nil && s.user != d.user && s != allowed {
+			h.sessionLock.Unlock()
+			if !h.mayJoin(r, s) {
+				return errForeignSession
+			}
+			allowed = s
+			continue
+		}
+
+		if s != nil && s.add(d) {
+			h.sessionLock.Unlock()
+			if h.readOnlyViewers {
+				d.writable.Store(false)
+			}
+			// the writability set by SetWritable applies to the clients joining later
+			s.lock.Lock()
+			if s.flipped {
+				d.writable.Store(s.writable)
+			}
+			s.lock.Unlock()
+			return nil
+		}
+
+		if cmd != nil {
+			if id == "" {
+				id = newSessionID()
+			}
+			s := &session{
+				h:          h,
+				id:         id,
+				cmd:        cmd,
+				policy:     h.resizePolicy,
+				request:    r,
+				remoteAddr: d.remoteAddr,
+				user:       d.user,
+			}
+			s.add(d)
+			if h.sessions != nil {
+				h.sessions[id] = s
+			}
+			if h.running == nil {
+				h.running = make(map[*session]struct{})
+			}
+			h.running[s] = struct{}{}
+			h.sessionLock.Unlock()
+			return nil
+		}
+		h.sessionLock.Unlock()
+
+		var err error
+		cmd, err = h.command(r)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var errForeignSession = &StatusError{Code: http.StatusForbidden, Message: "session of another user"}
+
+// mayJoin reports whether the client of the request may join the session of another user.
+func (h *Handler) mayJoin(r *http.Request, s *session) bool {
+	if h.joinFunc == nil {
+		return false
+	}
+	s.lock.Lock()
+	info := s.info()
+	s.lock.Unlock()
+	return h.joinFunc(r, info)
+}
+
+func (h *Handler) hasSession(id string) bool {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	_, ok := h.sessions[id]
+	return ok
+}
+
+func (h *Handler) removeSession(s *session) {
+	h.sessionLock.Lock()
+	if h.sessions[s.id] == s {
+		delete(h.sessions, s.id)
+	}
+	delete(h.running, s)
+	h.sessionLock.Unlock()
+}
+
+// Sessions returns the sorted IDs of the shared sessions currently served by the handler.
+// Clients can join one of them by specifying its ID with the session query parameter.
+// It's always empty if session sharing is not enabled.
+func (h *Handler) Sessions() []string {
+	h.sessionLock.Lock()
+	ids := make([]string, 0, len(h.sessions))
+	for id := range h.sessions {
+		ids = append(ids, id)
+	}
+	h.sessionLock.Unlock()
+	slices.Sort(ids)
+	return ids
+}
+
+var errNoSession = &StatusError{Code: http.StatusNotFound, Message: "session not found"}
+
+// SetWritable changes whether the input of the clients attached to the running session is forwarded to the tty,
+// including the clients joining later. The clients are told to enable or disable their input with a setPreference
+// message. The session ID is the one in SessionInfo, regardless of whether session sharing is enabled.
+func (h *Handler) SetWritable(id string, writable bool) error {
+	var s *session
+	h.sessionLock.Lock()
+	for rs := range h.running {
+		if rs.id == id {
+			s = rs
+			break
+		}
+	}
+	h.sessionLock.Unlock()
+	if s == nil {
+		return errNoSession
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writable = writable
+	s.flipped = true
+	msg := writablePreference(writable)
+	for _, d := range s.clients {
+		if d.writable.Swap(writable) != writable {
+			d.notify(msg)
+		}
+	}
+	return nil
+}
+
+// writablePreference returns the setPreference message enabling or disabling the input of the clients.
+func writablePreference(writable bool) []byte {
+	if writable {
+		return append([]byte{setPreference}, `{"disableStdin":false}`...)
+	}
+	return append([]byte{setPreference}, `{"disableStdin":true}`...)
+}
@@ -0,0 +1,297 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+	"github.com/gobwas/ws"
+)
+
+// clients returns the number of clients attached to the only running session of the handler, or -1 if there is none.
+func clients(h *Handler) int {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	for s := range h.running {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.clients)
+	}
+	return -1
+}
+
+// bytesOut returns the number of bytes read from the tty of the only running session of the handler.
+func bytesOut(h *Handler) int64 {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	for s := range h.running {
+		return s.bytesOut.Load()
+	}
+	return 0
+}
+
+// lastInput returns the time of the latest input received from the clients of the only running session of the handler,
+// whether it's forwarded to the tty or not.
+func lastInput(h *Handler) int64 {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	var last int64
+	for s := range h.running {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for _, d := range s.clients {
+			last = max(last, d.lastInput.Load())
+		}
+	}
+	return last
+}
+
+// drain reads the output of the client until the connection is closed, and returns the number of bytes read so far.
+func drain(conn *client.Conn) func() int64 {
+	var received atomic.Int64
+	go func() {
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := conn.Read(buf)
+			received.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return received.Load
+}
+
+func TestStalledViewer(t *testing.T) {
+	h := NewCommandHandler(shell("exec yes"), EnableSessionSharing(ResizeSmallest))
+	h.stallTimeout = 100 * time.Millisecond
+	url := startServer(t, h) + "/?session=shared"
+
+	received := drain(dial(t, url))
+	dialStalled(t, url)
+	waitFor(t, "the viewer to join", func() bool {
+		return clients(h) == 2
+	})
+
+	// the stalled viewer fills its socket buffers and queue, and is dropped
+	waitFor(t, "the viewer to be dropped", func() bool {
+		return clients(h) == 1
+	})
+	before := received()
+	waitFor(t, "more output", func() bool {
+		return received() > before
+	})
+}
+
+func TestSlowReader(t *testing.T) {
+	h := NewCommandHandler(shell("exec yes"))
+	h.stallTimeout = 10 * time.Millisecond
+	url := startServer(t, h)
+
+	// a client alone in its session only holds up its own output, however long it takes to read again
+	conn := dial(t, url)
+	waitFor(t, "the output to stall", func() bool {
+		before := bytesOut(h)
+		time.Sleep(10 * h.stallTimeout)
+		return bytesOut(h) == before
+	})
+	received := drain(conn)
+	waitFor(t, "the output to resume", func() bool {
+		return received() > maxQueued
+	})
+	if n := clients(h); n != 1 {
+		t.Fatalf("%d clients attached after reading again", n)
+	}
+}
+
+func TestPausedClient(t *testing.T) {
+	h := NewCommandHandler(shell("exec yes"))
+	h.stallTimeout = 10 * time.Millisecond
+	url := startServer(t, h)
+
+	conn := dial(t, url)
+	drain(conn)
+	if err := conn.Pause(); err != nil {
+		t.Fatal("pause:", err)
+	}
+	// no output is read from the tty while the client is paused, even long after the stall timeout
+	var stalled int64
+	waitFor(t, "the output to stop", func() bool {
+		stalled = bytesOut(h)
+		time.Sleep(10 * h.stallTimeout)
+		return bytesOut(h) == stalled
+	})
+	time.Sleep(10 * h.stallTimeout)
+	if n := bytesOut(h); n != stalled {
+		t.Fatalf("output of the paused client went on from %d to %d bytes", stalled, n)
+	}
+
+	if err := conn.Resume(); err != nil {
+		t.Fatal("resume:", err)
+	}
+	waitFor(t, "the output to resume", func() bool {
+		return bytesOut(h) > stalled
+	})
+}
+
+func TestJoinOtherUser(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		options := []HandlerOption{EnableSessionSharing(ResizeSmallest)}
+		if allow {
+			options = append(options, WithJoinFunc(func(r *http.Request, info SessionInfo) bool {
+				return RequestUser(r) == "admin" && info.User == "alice"
+			}))
+		}
+		h := NewCommandHandler(shell("sleep 1; echo bye"), options...)
+		url := startServer(t, withTestUser(h)) + "/?session=s1"
+
+		dial(t, url, client.WithHeader("X-Test-User", "alice"))
+		waitFor(t, "the session", func() bool {
+			return slices.Contains(h.Sessions(), "s1")
+		})
+		admin := dial(t, url, client.WithHeader("X-Test-User", "admin"))
+		out, ce := readAll(t, admin)
+		switch {
+		case allow && ce != nil && ce.Code != ws.StatusNormalClosure:
+			t.Fatal("join refused:", ce)
+		case allow && !strings.Contains(out, "bye"):
+			t.Fatalf("output of the joined session = %q", out)
+		case !allow && (ce == nil || ce.Code != ws.StatusPolicyViolation):
+			t.Fatalf("join of another user's session closed with %v", ce)
+		}
+	}
+}
+
+func TestJoinUnstartedSession(t *testing.T) {
+	pids := make(chan int, 1)
+	h := NewCommandHandler(shell("echo bye"), EnableSessionSharing(ResizeSmallest), WithJoinFunc(func(r *http.Request, info SessionInfo) bool {
+		pids <- info.Pid
+		return true
+	}))
+	url := startServer(t, withTestUser(h)) + "/?session=s1"
+
+	// the first client never reports its size, so the process isn't started when the second one joins
+	dialRaw(t, url)
+	waitFor(t, "the session", func() bool {
+		return slices.Contains(h.Sessions(), "s1")
+	})
+	out, ce := readAll(t, dial(t, url, client.WithHeader("X-Test-User", "admin")))
+	if ce == nil || ce.Code != ws.StatusNormalClosure || !strings.Contains(out, "bye") {
+		t.Fatalf("output of the joined session = %q, %v", out, ce)
+	}
+	if pid := <-pids; pid != 0 {
+		t.Fatalf("pid of the unstarted session = %d", pid)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	h := NewCommandHandler(shell("echo pid $$; read line; echo got $line"), EnableClientInput(), EnableDetach(time.Minute), WithScrollback(1024))
+	url := startServer(t, h) + "/?session=s1"
+
+	conn := dial(t, url)
+	first, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+	_ = conn.Close()
+	waitFor(t, "the client to detach", func() bool {
+		return clients(h) == 0
+	})
+
+	// the reattached client gets the output it missed and talks to the same process
+	conn = dial(t, url)
+	if _, err = conn.Write([]byte("again\n")); err != nil {
+		t.Fatal("write:", err)
+	}
+	out, ce := readAll(t, conn)
+	if ce == nil || ce.Code != ws.StatusNormalClosure || !strings.HasPrefix(out, first) || !strings.Contains(out, "got again") {
+		t.Fatalf("output after reattaching = %q, %v", out, ce)
+	}
+}
+
+func TestDetachGrace(t *testing.T) {
+	h := NewCommandHandler(shell("exec sleep 5"), EnableDetach(100*time.Millisecond))
+	url := startServer(t, h) + "/?session=s1"
+
+	conn := dial(t, url)
+	waitFor(t, "the client to attach", func() bool {
+		return clients(h) == 1
+	})
+	_ = conn.Close()
+	waitFor(t, "the detached session to end", func() bool {
+		return len(h.Sessions()) == 0
+	})
+}
+
+func TestSetWritable(t *testing.T) {
+	h := NewCommandHandler(shell("read a; echo got $a; read b; echo got $b"), EnableSessionSharing(ResizeSmallest))
+	url := startServer(t, h) + "/?session=s1"
+	if err := h.SetWritable("s1", true); err != errNoSession {
+		t.Fatal("set writable without the session:", err)
+	}
+
+	var disabled atomic.Value
+	drain(dial(t, url, client.OnPreferences(func(preferences map[string]any) {
+		if v, ok := preferences["disableStdin"]; ok {
+			disabled.Store(v)
+		}
+	})))
+	waitFor(t, "the session", func() bool {
+		return clients(h) == 1
+	})
+	disabledIs := func(v bool) func() bool {
+		return func() bool {
+			return disabled.Load() == v
+		}
+	}
+
+	if err := h.SetWritable("s1", true); err != nil {
+		t.Fatal("set writable:", err)
+	}
+	waitFor(t, "the input to be enabled", disabledIs(false))
+	// the client joining later is writable too
+	conn := dial(t, url)
+	write := func(s string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(s)); err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+	write("one\n")
+	var out []byte
+	buf := make([]byte, 1024)
+	for !bytes.Contains(out, []byte("got one")) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("output = %q, %v", out, err)
+		}
+		out = append(out, buf[:n]...)
+	}
+
+	if err := h.SetWritable("s1", false); err != nil {
+		t.Fatal("set read-only:", err)
+	}
+	waitFor(t, "the input to be disabled", disabledIs(true))
+	before := lastInput(h)
+	write("two\n")
+	waitFor(t, "the input to be discarded", func() bool {
+		return lastInput(h) > before
+	})
+	if err := h.SetWritable("s1", true); err != nil {
+		t.Fatal("set writable:", err)
+	}
+	write("three\n")
+
+	rest, ce := readAll(t, conn)
+	if ce == nil || ce.Code != ws.StatusNormalClosure || !strings.Contains(rest, "got three") || strings.Contains(rest, "two") {
+		t.Fatalf("output = %q, %v", rest, ce)
+	}
+}
@@ -0,0 +1,165 @@
+package ttyd
+
+import (
+	"context"
+	"net/http"
+	"syscall"
+
+	"github.com/gobwas/ws"
+)
+
+var errShutdown = &StatusError{Code: http.StatusServiceUnavailable, Message: "server shutting down"}
+
+// track registers the daemon so that it can be closed by Shutdown. It fails if the handler is shut down.
+func (h *Handler) track(d *daemon) bool {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	if h.shutdown {
+		return false
+	}
+
+	if h.daemons == nil {
+		h.daemons = make(map[*daemon]struct{})
+	}
+	h.daemons[d] = struct{}{}
+	return true
+}
+
+func (h *Handler) untrack(d *daemon) {
+	h.sessionLock.Lock()
+	delete(h.daemons, d)
+	h.sessionLock.Unlock()
+}
+
+// trackMux registers the multiplexed connection so that it can be closed by Shutdown. It fails if the handler is shut down.
+func (h *Handler) trackMux(m *mux) bool {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	if h.shutdown {
+		return false
+	}
+
+	if h.muxes == nil {
+		h.muxes = make(map[*mux]struct{})
+	}
+	h.muxes[m] = struct{}{}
+	return true
+}
+
+func (h *Handler) untrackMux(m *mux) {
+	h.sessionLock.Lock()
+	delete(h.muxes, m)
+	h.sessionLock.Unlock()
+}
+
+func (h *Handler) isShutdown() bool {
+	h.sessionLock.Lock()
+	defer h.sessionLock.Unlock()
+	return h.shutdown
+}
+
+// Shutdown gracefully terminates all the sessions served by the handler. New connections are rejected,
+// every client receives a close frame with the reason, and the processes are signaled to terminate.
+// If any process is still running when ctx is done, ctx's error is returned and all the remaining processes are
+// killed in the background, Shutdown doesn't wait for clients that stopped reading.
+// The handler can't serve new sessions after Shutdown is called.
+func (h *Handler) Shutdown(ctx context.Context, reason string) error {
+	h.sessionLock.Lock()
+	h.shutdown = true
+	daemons := make([]*daemon, 0, len(h.daemons))
+	for d := range h.daemons {
+		daemons = append(daemons, d)
+	}
+	sessions := make([]*session, 0, len(h.running))
+	for s := range h.running {
+		sessions = append(sessions, s)
+	}
+	muxes := make([]*mux, 0, len(h.muxes))
+	for m := range h.muxes {
+		muxes = append(muxes, m)
+	}
+	h.sessionLock.Unlock()
+
+	// the sessions may be locked for a while by their clients, so they're terminated in the background
+	// and the processes are killed once they're all signaled if ctx is done first
+	var waited []chan struct{}
+	terminated := make(chan struct{})
+	go func() {
+		defer close(terminated)
+		// mark the sessions as closing first, so that the clients are detached without closing the sessions synchronously
+		for _, s := range sessions {
+			s.lock.Lock()
+			s.closing = true
+			s.setReason(ReasonShutdown)
+			s.lock.Unlock()
+		}
+		for _, d := range daemons {
+			d.close(ReasonShutdown, ws.StatusGoingAway, reason)
+		}
+		// multiplexed connections are closed after their channels
+		for _, m := range muxes {
+			m.shutdown(ws.StatusGoingAway, reason)
+		}
+
+		for _, s := range sessions {
+			if w := s.terminate(); w != nil {
+				waited = append(waited, w)
+			}
+		}
+	}()
+
+	kill := func() error {
+		go func() {
+			<-terminated
+			for _, s := range sessions {
+				s.kill()
+			}
+		}()
+		return ctx.Err()
+	}
+	select {
+	case <-terminated:
+	case <-ctx.Done():
+		return kill()
+	}
+	for _, w := range waited {
+		select {
+		case <-w:
+		case <-ctx.Done():
+			return kill()
+		}
+	}
+	return nil
+}
+
+// terminate signals the process to terminate and closes the session in the background.
+// It returns the channel closed after the process is waited, or nil if the process isn't started.
+func (s *session) terminate() chan struct{} {
+	s.lock.Lock()
+	started := s.file != nil
+	s.lock.Unlock()
+
+	if started {
+		_ = signalProcess(s.cmd.Process, syscall.SIGTERM)
+	}
+	go s.close()
+	if started {
+		return s.waited
+	}
+	return nil
+}
+
+// kill kills the process if it's still running.
+func (s *session) kill() {
+	s.lock.Lock()
+	started := s.file != nil
+	s.lock.Unlock()
+
+	if started {
+		select {
+		case <-s.waited:
+		default:
+			_ = signalProcess(s.cmd.Process, syscall.SIGKILL)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownStalledClient(t *testing.T) {
+	for _, tt := range []struct {
+		script string
+		err    error
+	}{
+		{"exec yes", nil},
+		// the process ignores the signals and is killed once ctx is done
+		{"trap '' TERM HUP; yes | head -c 100000000; exec sleep 60", context.DeadlineExceeded},
+	} {
+		h := NewCommandHandler(shell(tt.script))
+		url := startServer(t, h)
+		dialStalled(t, url)
+		// the output stops once the buffers of the client are full
+		waitFor(t, "the output to stall", func() bool {
+			before := bytesOut(h)
+			time.Sleep(50 * time.Millisecond)
+			return before > 0 && bytesOut(h) == before
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		start := time.Now()
+		err := h.Shutdown(ctx, "bye")
+		cancel()
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("%s: Shutdown took %v", tt.script, elapsed)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%s: Shutdown = %v, want %v", tt.script, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package ttyd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// DefaultTimeoutWarning is how long before the idle timeout or the end of the maximum duration the clients are warned
+// by default.
+const DefaultTimeoutWarning = time.Minute
+
+// timeout is the earliest time a client times out.
+type timeout struct {
+	at     time.Time
+	reason TerminationReason
+	// warning is how long before at the client is warned with the message, zero if it's not warned.
+	warning time.Duration
+	message string
+}
+
+// watches reports whether the client needs watchLoop.
+func (h *Handler) watches(d *daemon) bool {
+	return h.pingInterval > 0 || (d.session != nil && (h.inputTimeout > 0 || h.outputTimeout > 0 || h.maxDuration > 0))
+}
+
+// warningBefore returns how long before the timeout the clients are warned.
+func (h *Handler) warningBefore(timeout time.Duration) time.Duration {
+	return max(min(h.timeoutWarning, timeout/2), 0)
+}
+
+// nextTimeout returns the earliest timeout of the client, or a zero timeout if there is none.
+// Timeouts about sessions don't apply to replays.
+func (h *Handler) nextTimeout(d *daemon) timeout {
+	var next timeout
+	add := func(t timeout) {
+		if next.at.IsZero() || t.at.Before(next.at) {
+			next = t
+		}
+	}
+
+	if h.pingInterval > 0 && h.pongTimeout > 0 {
+		if pinged := d.conn.pinged.Load(); pinged != 0 {
+			add(timeout{
+				at:     time.Unix(0, pinged).Add(h.pongTimeout),
+				reason: ReasonPongTimeout,
+			})
+		}
+	}
+
+	s := d.session
+	if s == nil {
+		return next
+	}
+	if h.inputTimeout > 0 {
+		add(timeout{
+			at:      time.Unix(0, d.lastInput.Load()).Add(h.inputTimeout),
+			reason:  ReasonIdleTimeout,
+			warning: h.warningBefore(h.inputTimeout),
+			message: "no input for " + h.inputTimeout.String() + ", disconnecting in %v",
+		})
+	}
+	if h.outputTimeout > 0 {
+		// clients joining a quiet session aren't disconnected right away
+		last := max(s.lastOutput.Load(), d.since.UnixNano())
+		add(timeout{
+			at:      time.Unix(0, last).Add(h.outputTimeout),
+			reason:  ReasonIdleTimeout,
+			warning: h.warningBefore(h.outputTimeout),
+			message: "no output for " + h.outputTimeout.String() + ", disconnecting in %v",
+		})
+	}
+	if h.maxDuration > 0 {
+		s.lock.Lock()
+		start := s.startTime
+		s.lock.Unlock()
+		if start.IsZero() {
+			start = d.since
+		}
+		add(timeout{
+			at:      start.Add(h.maxDuration),
+			reason:  ReasonTimeLimit,
+			warning: h.warningBefore(h.maxDuration),
+			message: "the session reaches its time limit of " + h.maxDuration.String() + " in %v",
+		})
+	}
+	return next
+}
+
+// watchLoop sends the pings and enforces the timeouts of the client until done is closed or the client is closed.
+// When the client times out, its read deadline is moved to now to interrupt readLoop, which closes the client
+// with the reason of the timeout.
+func (h *Handler) watchLoop(d *daemon, done chan struct{}) {
+	var (
+		timer    *time.Timer
+		nextPing time.Time
+		warned   time.Time
+	)
+	if h.pingInterval > 0 {
+		nextPing = time.Now().Add(h.pingInterval)
+	}
+	for !d.ioErr.Load() {
+		now := time.Now()
+		if !nextPing.IsZero() && !now.Before(nextPing) {
+			err := d.conn.Ping()
+			if err != nil {
+				d.close(ReasonPingFailure, ws.StatusGoingAway, "ping failure")
+				break
+			}
+			nextPing = now.Add(h.pingInterval)
+		}
+
+		next := nextPing
+		t := h.nextTimeout(d)
+		if !t.at.IsZero() {
+			if !now.Before(t.at) {
+				d.timeout = t.reason
+				d.expired.Store(true)
+				_ = d.conn.conn.SetReadDeadline(now)
+				break
+			}
+
+			warnAt := t.at.Add(-t.warning)
+			switch {
+			case t.warning <= 0 || warned.Equal(t.at):
+			case now.Before(warnAt):
+				next = earliest(next, warnAt)
+			default:
+				// warned once for each timeout, activity postpones it and rearms the warning
+				warned = t.at
+				d.warn(fmt.Sprintf(t.message, t.at.Sub(now).Round(time.Second)))
+			}
+			next = earliest(next, t.at)
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(next.Sub(now))
+			defer timer.Stop()
+		} else {
+			timer.Reset(next.Sub(now))
+		}
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// earliest returns the earlier of the times, ignoring zero times.
+func earliest(t, u time.Time) time.Time {
+	if t.IsZero() || (!u.IsZero() && u.Before(t)) {
+		return u
+	}
+	return t
+}
+
+// warn writes the message to the terminal of the client as output, unless its output queue is full.
+func (d *daemon) warn(msg string) {
+	s := d.session
+	s.lock.Lock()
+	d.notify([]byte(string(output) + "\r\n\x1b[1;33m[ttyd] " + msg + "\x1b[0m\r\n"))
+	s.lock.Unlock()
+}
+
+// detachGrace returns how long the session is kept running after its last client disconnects,
+// which is cut short by the maximum duration. The lock must be held.
+func (s *session) detachGrace() time.Duration {
+	grace := s.h.detachTimeout
+	if s.h.maxDuration > 0 {
+		grace = min(grace, time.Until(s.startTime.Add(s.h.maxDuration)))
+	}
+	return grace
+}
+
+// end ends the session for the reason, closing its tty and all the clients.
+func (s *session) end(reason TerminationReason) {
+	s.lock.Lock()
+	s.closing = true
+	s.setReason(reason)
+	s.lock.Unlock()
+	s.close()
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		option  HandlerOption
+		warning string
+		reason  TerminationReason
+	}{
+		{WithIdleTimeout(300*time.Millisecond, 0), "no input for 300ms", ReasonIdleTimeout},
+		{WithIdleTimeout(0, 300*time.Millisecond), "no output for 300ms", ReasonIdleTimeout},
+		{WithMaxDuration(300 * time.Millisecond), "time limit of 300ms", ReasonTimeLimit},
+	} {
+		ended := make(chan SessionInfo, 1)
+		h := NewCommandHandler(shell("exec sleep 5"), tt.option, WithTimeoutWarning(100*time.Millisecond), OnSessionEnd(func(info SessionInfo) {
+			ended <- info
+		}))
+		out, ce := readAll(t, dial(t, startServer(t, h)))
+		if !strings.Contains(out, tt.warning) {
+			t.Fatalf("%s: no warning in %q", tt.reason, out)
+		}
+		if ce == nil || ce.Code != ws.StatusNormalClosure || ce.Reason != tt.reason.String() {
+			t.Fatalf("%s: closed with %v", tt.reason, ce)
+		}
+		if info := <-ended; info.Reason != tt.reason {
+			t.Fatalf("%s: session ended for %s", tt.reason, info.Reason)
+		}
+	}
+}
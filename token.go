@@ -0,0 +1,126 @@
+package ttyd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+	errTokenUsed    = errors.New("token already used")
+)
+
+// DefaultTokenTTL is the lifetime of the tokens issued by a TokenAuth if none is specified.
+const DefaultTokenTTL = 30 * time.Second
+
+// TokenAuth issues short-lived HMAC-signed tokens bound to the authenticated user, and verifies the token sent
+// in the first message of ttyd protocol. Use it as the /token handler, and enable it with EnableTokenAuth.
+// Each token is only accepted once, so clients fetch a new one for every connection as ttyd clients do.
+type TokenAuth struct {
+	key []byte
+	ttl time.Duration
+
+	lock sync.Mutex
+	// used holds the expiry of the accepted tokens until they expire, by their signatures
+	used map[string]int64
+}
+
+// NewTokenAuth returns a TokenAuth signing the tokens with key, and the tokens are valid for ttl after issued.
+// If key is empty, a random key is generated, so tokens can't be verified by other processes.
+// If ttl is zero or negative, DefaultTokenTTL is used.
+func NewTokenAuth(key []byte, ttl time.Duration) *TokenAuth {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	return &TokenAuth{
+		key:  key,
+		ttl:  ttl,
+		used: make(map[string]int64),
+	}
+}
+
+// Token returns a new token for the user.
+func (t *TokenAuth) Token(user string) string {
+	payload := strconv.FormatInt(time.Now().Add(t.ttl).Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString([]byte(user))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload))
+}
+
+// Verify checks that the token is issued by t for the user, hasn't expired and hasn't been accepted before.
+// The token is accepted if it's valid, so a token replayed by someone who intercepted it is rejected.
+// Tokens issued by other processes with the same key can be replayed to this one.
+func (t *TokenAuth) Verify(token, user string) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return errInvalidToken
+	}
+	payload := token[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(mac, t.sign(payload)) {
+		return errInvalidToken
+	}
+
+	expiry, encoded, _ := strings.Cut(payload, ".")
+	name, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || string(name) != user {
+		return errInvalidToken
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+	now := time.Now().Unix()
+	if now > exp {
+		return errTokenExpired
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for sig, exp := range t.used {
+		if now > exp {
+			delete(t.used, sig)
+		}
+	}
+	if _, ok := t.used[string(mac)]; ok {
+		return errTokenUsed
+	}
+	t.used[string(mac)] = exp
+	return nil
+}
+
+func (t *TokenAuth) sign(payload string) []byte {
+	m := hmac.New(sha256.New, t.key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+// ServeHTTP serves a token for the user reported by RequestUser in the format expected by ttyd clients.
+// It should be placed behind the same authentication as the Handler.
+func (t *TokenAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(struct {
+		Token string `json:"token"`
+	}{t.Token(RequestUser(r))})
+}
+
+// verifyToken checks the token sent by the client if token authentication is enabled.
+func (d *daemon) verifyToken(token string) error {
+	if d.tokens == nil {
+		return nil
+	}
+	return d.tokens.Verify(token, d.user)
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+	"github.com/gobwas/ws"
+)
+
+func TestTokenAuthVerify(t *testing.T) {
+	ta := NewTokenAuth(nil, 0)
+	sign := func(expiry int64, user string) string {
+		payload := strconv.FormatInt(expiry, 10) + "." + base64.RawURLEncoding.EncodeToString([]byte(user))
+		return payload + "." + base64.RawURLEncoding.EncodeToString(ta.sign(payload))
+	}
+	token := ta.Token("alice")
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		user  string
+		err   error
+	}{
+		{"other user", token, "bob", errInvalidToken},
+		{"forged user", strings.Replace(token, base64.RawURLEncoding.EncodeToString([]byte("alice")), base64.RawURLEncoding.EncodeToString([]byte("bob")), 1), "bob", errInvalidToken},
+		{"forged expiry", "9" + token, "alice", errInvalidToken},
+		{"other key", NewTokenAuth(nil, 0).Token("alice"), "alice", errInvalidToken},
+		{"malformed", "token", "alice", errInvalidToken},
+		{"expired", sign(time.Now().Add(-time.Second).Unix(), "alice"), "alice", errTokenExpired},
+		{"valid", token, "alice", nil},
+		{"replayed", token, "alice", errTokenUsed},
+	} {
+		if err := ta.Verify(tt.token, tt.user); !errors.Is(err, tt.err) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTokenAuthHandler(t *testing.T) {
+	tokens := NewTokenAuth(nil, 0)
+	mux := http.NewServeMux()
+	mux.Handle("/token", tokens)
+	mux.Handle("/ws", NewCommandHandler(shell("echo hello"), EnableTokenAuth(tokens)))
+	url := startServer(t, withTestUser(mux))
+
+	req, _ := http.NewRequest(http.MethodGet, url+"/token", nil)
+	req.Header.Set("X-Test-User", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		user  string
+		token string
+		code  ws.StatusCode
+	}{
+		{"forged", "alice", "forged", ws.StatusPolicyViolation},
+		{"other user", "bob", body.Token, ws.StatusPolicyViolation},
+		{"valid", "alice", body.Token, ws.StatusNormalClosure},
+		{"replayed", "alice", body.Token, ws.StatusPolicyViolation},
+	} {
+		out, ce := readAll(t, dial(t, url+"/ws", client.WithHeader("X-Test-User", tt.user), client.WithToken(tt.token)))
+		if ce == nil || ce.Code != tt.code {
+			t.Fatalf("%s: closed with %v", tt.name, ce)
+		}
+		if started := strings.Contains(out, "hello"); started != (tt.code == ws.StatusNormalClosure) {
+			t.Fatalf("%s: output = %q", tt.name, out)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package ttyd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+type userKey struct{}
+
+// RequestWithUser returns a shallow copy of r whose context carries the name of the authenticated user.
+// Authentication middlewares in front of a Handler use it to tell the Handler who the client is.
+func RequestWithUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// RequestUser returns the name of the authenticated user set by RequestWithUser, or an empty string if there isn't one.
+func RequestUser(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// addrIP returns the IP of the address in the host:port form, or the address itself if it's not in that form.
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// UserEnv is the environment variable set to the authenticated user for the commands started by a Handler.
+const UserEnv = "TTYD_USER"
+
+var (
+	errUntrustedProxy = &StatusError{Code: http.StatusForbidden, Message: "untrusted proxy"}
+	errMissingUser    = &StatusError{Code: http.StatusUnauthorized, Message: "missing user"}
+)
+
+// AuthHeader returns a handler that takes the user from the header set by a reverse proxy and calls next with
+// the request carrying the user, so the rest of the site can be protected the same way as WithAuthHeader.
+// Requests not from the trusted proxies or without the header are rejected.
+func AuthHeader(next http.Handler, header string, trusted ...netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := headerUser(r, header, trusted)
+		if err != nil {
+			code, msg := errorStatus(err)
+			http.Error(w, msg, code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerUser returns the request carrying the user in the header if it's sent by a trusted proxy.
+// Requests over unix sockets are trusted, as the access is controlled by the file permissions.
+func headerUser(r *http.Request, header string, trusted []netip.Prefix) (*http.Request, error) {
+	if !trustedProxy(r, trusted) {
+		return nil, errUntrustedProxy
+	}
+	user := r.Header.Get(header)
+	if user == "" {
+		return nil, errMissingUser
+	}
+	return RequestWithUser(r, user), nil
+}
+
+func trustedProxy(r *http.Request, trusted []netip.Prefix) bool {
+	if overUnixSocket(r) {
+		return true
+	}
+	ip, err := netip.ParseAddr(addrIP(r.RemoteAddr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func overUnixSocket(r *http.Request) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && local.Network() == "unix"
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+
+package ttyd
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/WeidiDeng/ttyd-go/client"
+)
+
+func TestAuthHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		trusted string
+		header  []string
+		user    string
+		status  string
+	}{
+		{"trusted proxy", "127.0.0.0/8", []string{"X-User", "alice"}, "alice", ""},
+		{"missing user", "127.0.0.0/8", nil, "", "401"},
+		{"untrusted proxy", "192.0.2.0/24", []string{"X-User", "alice"}, "", "403"},
+		// the header is only trusted from the proxy itself, not from a client claiming to be behind it
+		{"spoofed proxy", "192.0.2.0/24", []string{"X-User", "alice", "X-Forwarded-For", "192.0.2.1", "Forwarded", "for=192.0.2.1"}, "", "403"},
+	} {
+		h := NewCommandHandler(shell(`echo "user=$`+UserEnv+`"`), WithAuthHeader("X-User", netip.MustParsePrefix(tt.trusted)))
+		url := startServer(t, h)
+
+		options := []client.Option{client.WithToken("")}
+		for i := 0; i < len(tt.header); i += 2 {
+			options = append(options, client.WithHeader(tt.header[i], tt.header[i+1]))
+		}
+		conn, err := client.Dial(context.Background(), url, options...)
+		if tt.status != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.status) {
+				t.Fatalf("%s: dial = %v, want status %s", tt.name, err, tt.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: dial = %v", tt.name, err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		if out, _ := readAll(t, conn); !strings.Contains(out, "user="+tt.user+"\r\n") {
+			t.Fatalf("%s: output = %q", tt.name, out)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package ttyd
 
+const ttyProtocol = "tty"
+
 const (
 	input          = '0'
 	resizeTerminal = '1'
@@ -22,3 +24,9 @@ type resizeRequest struct {
 	Columns uint16 `json:"columns"`
 	Rows    uint16 `json:"rows"`
 }
+
+// initRequest is the first message sent by the client.
+type initRequest struct {
+	AuthToken string `json:"AuthToken"`
+	resizeRequest
+}
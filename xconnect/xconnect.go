@@ -0,0 +1,29 @@
+// Package xconnect enables the extended CONNECT protocol of RFC 8441 for the HTTP/2 servers of net/http,
+// so that browsers can open WebSockets over HTTP/2 and multiplex many terminals over one connection.
+//
+// net/http only advertises SETTINGS_ENABLE_CONNECT_PROTOCOL if GODEBUG contains http2xconnect=1
+// when it's initialized. Import this package for its side effect in the main package:
+//
+//	import _ "github.com/WeidiDeng/ttyd-go/xconnect"
+//
+// It adds http2xconnect=1 to GODEBUG unless the setting is already present. Packages are initialized in
+// the order of their import paths among those whose dependencies are initialized, and this package only
+// depends on os and strings, so it's always initialized before net/http.
+// The commands started by the ttyd Handler get GODEBUG without the setting.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+func init() {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=") {
+		return
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	_ = os.Setenv("GODEBUG", godebug+"http2xconnect=1")
+}